@@ -0,0 +1,102 @@
+// alignment checks - what happens when the program accesses memory or jumps
+// to an address that isn't naturally aligned.
+package main
+
+import (
+	"fmt"
+)
+
+// INST_ALIGN is the required alignment of instruction addresses. It would be
+// 2 with the compressed instruction extension, which isn't supported.
+const INST_ALIGN = 4
+
+// AlignPolicy decides how misaligned accesses are treated
+type AlignPolicy uint8
+
+const (
+	ALIGN_POLICY_ALLOW AlignPolicy = iota // carry on as if aligned
+	ALIGN_POLICY_TRAP                     // stop with an AddrMisaligned error
+	ALIGN_POLICY_COUNT                    // carry on but keep count
+)
+
+func (a AlignPolicy) String() string {
+	switch a {
+	case ALIGN_POLICY_ALLOW:
+		return "allow"
+	case ALIGN_POLICY_TRAP:
+		return "trap"
+	case ALIGN_POLICY_COUNT:
+		return "count"
+	}
+	return fmt.Sprintf("AlignPolicy(%d)", uint8(a))
+}
+
+func (a *AlignPolicy) Set(val string) error {
+	switch val {
+	case "allow":
+		*a = ALIGN_POLICY_ALLOW
+	case "trap":
+		*a = ALIGN_POLICY_TRAP
+	case "count":
+		*a = ALIGN_POLICY_COUNT
+	default:
+		return fmt.Errorf("unknown misaligned access policy %q", val)
+	}
+	return nil
+}
+
+// AlignAccess is the kind of access being checked for alignment
+type AlignAccess uint8
+
+const (
+	ALIGN_LOAD AlignAccess = iota
+	ALIGN_STORE
+	ALIGN_JUMP
+)
+
+func (a AlignAccess) String() string {
+	switch a {
+	case ALIGN_LOAD:
+		return "load"
+	case ALIGN_STORE:
+		return "store"
+	case ALIGN_JUMP:
+		return "jump"
+	}
+	return fmt.Sprintf("AlignAccess(%d)", uint8(a))
+}
+
+// AddrMisaligned is the exit cause of a misaligned access under the trap
+// policy
+type AddrMisaligned struct {
+	access AlignAccess
+	addr   VirtAddr
+	align  uint
+	pc     uint64
+}
+
+func (a AddrMisaligned) Error() string {
+	return fmt.Sprintf("AddrMisaligned{access: %s, addr: %#x, align: %d, pc: %#x}",
+		a.access, a.addr, a.align, a.pc)
+}
+
+// checkAlign applies the misaligned access policy to an access of `align`
+// bytes at `addr`
+func (e *Emulator) checkAlign(addr VirtAddr, align uint, access AlignAccess) error {
+	if uint(addr)&(align-1) == 0 {
+		return nil
+	}
+	switch MISALIGNED {
+	case ALIGN_POLICY_TRAP:
+		return AddrMisaligned{access, addr, align, e.Reg(Pc)}
+	case ALIGN_POLICY_COUNT:
+		e.misaligned[access]++
+	}
+	return nil
+}
+
+// MisalignedReport describes the misaligned accesses counted so far
+func (e *Emulator) MisalignedReport() string {
+	return fmt.Sprintf("misaligned accesses: %d loads, %d stores, %d jumps",
+		e.misaligned[ALIGN_LOAD], e.misaligned[ALIGN_STORE], e.misaligned[ALIGN_JUMP])
+}
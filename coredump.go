@@ -0,0 +1,182 @@
+// core dumps - write the state of a crashed program as an ELF core file that
+// gdb can open together with the program.
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"os"
+)
+
+// signals reported in the core file for the ways a program can crash
+const (
+	SIGILL  = 4
+	SIGTRAP = 5
+	SIGABRT = 6
+	SIGBUS  = 7
+	SIGSEGV = 11
+)
+
+// sizes of the structures making up a 64-bit core file
+const (
+	ELF64_EHDR_SIZE = 64
+	ELF64_PHDR_SIZE = 56
+	PRSTATUS_SIZE   = 376
+)
+
+// coreSignal is the signal a Linux kernel would have killed the program with
+// for the exit cause `err`
+func coreSignal(err error) (int, bool) {
+	switch err.(type) {
+	case MMUError, StackOverflow:
+		return SIGSEGV, true
+	case AddrMisaligned:
+		return SIGBUS, true
+	case HeapError:
+		return SIGABRT, true
+	case IllegalInstruction:
+		return SIGILL, true
+	case Ebreak:
+		return SIGTRAP, true
+	}
+	return 0, false
+}
+
+// coreRegion is a run of pages with the same permissions
+type coreRegion struct {
+	addr  VirtAddr
+	size  uint
+	flags elf.ProgFlag
+}
+
+// coreRegions returns the mapped memory, every page with some permission,
+// merged into runs of pages with the same permissions
+func (m *Mmu) coreRegions() []coreRegion {
+	var regions []coreRegion
+	for i, p := range m.pages {
+		var perm Perm
+		for _, b := range p.perms {
+			perm |= b
+		}
+		var flags elf.ProgFlag
+		if perm&(PERM_READ|PERM_RAW) != 0 {
+			flags |= elf.PF_R
+		}
+		if perm&PERM_WRITE != 0 {
+			flags |= elf.PF_W
+		}
+		if perm&PERM_EXEC != 0 {
+			flags |= elf.PF_X
+		}
+		if flags == 0 {
+			continue
+		}
+
+		// the last page is cut short when memory isn't a whole number of pages
+		addr := VirtAddr(i * PAGE_SIZE)
+		size := PAGE_SIZE - uint(max(uint(addr)+PAGE_SIZE, m.size)-m.size)
+		if n := len(regions); n > 0 && regions[n-1].flags == flags &&
+			regions[n-1].addr+VirtAddr(regions[n-1].size) == addr {
+			regions[n-1].size += size
+			continue
+		}
+		regions = append(regions, coreRegion{addr, size, flags})
+	}
+	return regions
+}
+
+// prstatus encodes the NT_PRSTATUS note of the program's only thread
+func (e *Emulator) prstatus(sig int) []uint8 {
+	desc := make([]uint8, PRSTATUS_SIZE)
+	le := binary.LittleEndian
+	le.PutUint32(desc[0:], uint32(sig))  // pr_info.si_signo
+	le.PutUint16(desc[12:], uint16(sig)) // pr_cursig
+	le.PutUint32(desc[32:], TID)         // pr_pid
+
+	// pr_reg is the pc followed by x1 to x31
+	le.PutUint64(desc[112:], e.Reg(Pc))
+	for r := Ra; r <= T6; r++ {
+		le.PutUint64(desc[112+8*int(r):], e.Reg(r))
+	}
+	return desc
+}
+
+// note encodes an ELF note, name and descriptor are padded to 4 bytes
+func note(name string, typ elf.NType, desc []uint8) []uint8 {
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&buf, le, []uint32{uint32(len(name) + 1), uint32(len(desc)), uint32(typ)})
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+	buf.Write(desc)
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes()
+}
+
+// WriteCore writes a core file of the program killed by signal `sig` to
+// `path`. It has a PT_NOTE segment with the registers and a PT_LOAD segment
+// for every mapped region of memory.
+func (e *Emulator) WriteCore(path string, sig int) error {
+	notes := note("CORE", elf.NT_PRSTATUS, e.prstatus(sig))
+	regions := e.coreRegions()
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	phnum := 1 + len(regions)
+	ehdr := elf.Header64{
+		Type:      uint16(elf.ET_CORE),
+		Machine:   uint16(elf.EM_RISCV),
+		Version:   uint32(elf.EV_CURRENT),
+		Phoff:     ELF64_EHDR_SIZE,
+		Ehsize:    ELF64_EHDR_SIZE,
+		Phentsize: ELF64_PHDR_SIZE,
+		Phnum:     uint16(phnum),
+	}
+	copy(ehdr.Ident[:], elf.ELFMAG)
+	ehdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	ehdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	ehdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	ehdr.Ident[elf.EI_OSABI] = byte(elf.ELFOSABI_NONE)
+	binary.Write(&buf, le, ehdr)
+
+	// notes follow the program headers, memory starts on the next page
+	off := uint64(ELF64_EHDR_SIZE + ELF64_PHDR_SIZE*phnum)
+	binary.Write(&buf, le, elf.Prog64{
+		Type:   uint32(elf.PT_NOTE),
+		Off:    off,
+		Filesz: uint64(len(notes)),
+		Align:  4,
+	})
+	off = (off + uint64(len(notes)) + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	for _, r := range regions {
+		binary.Write(&buf, le, elf.Prog64{
+			Type:   uint32(elf.PT_LOAD),
+			Flags:  uint32(r.flags),
+			Off:    off,
+			Vaddr:  uint64(r.addr),
+			Filesz: uint64(r.size),
+			Memsz:  uint64(r.size),
+			Align:  PAGE_SIZE,
+		})
+		off += uint64(r.size)
+	}
+	buf.Write(notes)
+
+	for _, r := range regions {
+		for buf.Len()%PAGE_SIZE != 0 {
+			buf.WriteByte(0)
+		}
+		mem := make([]uint8, r.size)
+		if err := e.copyBytes(r.addr, mem); err != nil {
+			return err
+		}
+		buf.Write(mem)
+	}
+	return os.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,83 @@
+// memory mapped devices - peripherals the program talks to through loads and
+// stores to their address range instead of through syscalls.
+package main
+
+import (
+	"fmt"
+)
+
+// Device is a peripheral mapped into memory. Accesses are 1, 2, 4 or 8 bytes
+// wide and `offset` is relative to the start of the device's range.
+type Device interface {
+	Read(offset uint64, size uint) (uint64, error)
+	Write(offset uint64, size uint, val uint64) error
+}
+
+// devMapping is a device and the range of addresses it answers to
+type devMapping struct {
+	base VirtAddr
+	size uint
+	dev  Device
+}
+
+// MapDevice attaches `dev` to the `size` bytes from `base`. Device ranges can
+// be anywhere in the address space, even beyond the end of memory, but can't
+// overlap each other.
+func (m *Mmu) MapDevice(base VirtAddr, size uint, dev Device) error {
+	for _, d := range m.devices {
+		if base < d.base+VirtAddr(d.size) && d.base < base+VirtAddr(size) {
+			return fmt.Errorf("device at [%#x -> %#x] overlaps device at [%#x -> %#x]",
+				base, uint(base)+size, d.base, uint(d.base)+d.size)
+		}
+	}
+	m.devices = append(m.devices, devMapping{base, size, dev})
+	return nil
+}
+
+// device returns the device whose range overlaps the `size` bytes from
+// `addr`, an access only partly inside the range fails the device's check
+func (m *Mmu) device(addr VirtAddr, size uint) (devMapping, bool) {
+	end := uint(addr) + max(size, 1)
+	for _, d := range m.devices {
+		if uint(addr) < uint(d.base)+d.size && uint(d.base) < end {
+			return d, true
+		}
+	}
+	return devMapping{}, false
+}
+
+// check validates an access to the device
+func (d devMapping) check(addr VirtAddr, size int) error {
+	switch size {
+	case 1, 2, 4, 8:
+	default:
+		return MMUError{typ: ErrDevice, addr: addr, size: uint(size)}
+	}
+	if addr < d.base || uint(addr)+uint(size) > uint(d.base)+d.size {
+		return MMUError{typ: ErrDevice, addr: addr, size: uint(size)}
+	}
+	return nil
+}
+
+// read reads len(buf) bytes from the device into buf
+func (d devMapping) read(addr VirtAddr, buf []uint8) error {
+	if err := d.check(addr, len(buf)); err != nil {
+		return err
+	}
+	val, err := d.dev.Read(uint64(addr-d.base), uint(len(buf)))
+	if err != nil {
+		return err
+	}
+	for i := range buf {
+		buf[i] = uint8(val >> (8 * i))
+	}
+	return nil
+}
+
+// write writes buf to the device
+func (d devMapping) write(addr VirtAddr, buf []uint8) error {
+	if err := d.check(addr, len(buf)); err != nil {
+		return err
+	}
+	return d.dev.Write(uint64(addr-d.base), uint(len(buf)), leValue(buf))
+}
@@ -3,8 +3,10 @@
 package main
 
 import (
+	"bytes"
 	"debug/elf"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"unsafe"
@@ -18,8 +20,31 @@ type Emulator struct {
 	*Mmu
 	program    ElfBinary
 	programBrk VirtAddr
+	initialBrk VirtAddr
 	registers  [33]uint64
-	files      map[int]*os.File
+	files      *FileTable
+
+	// virtual clock, the number of instructions executed so far
+	icount uint64
+
+	// misaligned accesses seen when counting them
+	misaligned [3]uint64
+
+	// address cleared when the thread exits, from set_tid_address
+	tidAddress VirtAddr
+
+	// addresses and instruction count to stop execution at
+	breakpoints map[VirtAddr]bool
+	breakIcount uint64
+
+	// functions that run in place of the program's code at an address
+	hooks map[VirtAddr]func(*Emulator) error
+
+	// return addresses of the calls currently executing
+	callstack []uint64
+
+	// checked allocator backing the program's malloc and friends
+	san *Sanitizer
 }
 
 // ElfBinary holds data necessary to succefully prepare program for execution.
@@ -28,17 +53,32 @@ type ElfBinary struct {
 	args       []string
 	entry      uint64
 	segments   []elf.ProgHeader
+	symbols    []elf.Symbol
+
+	// where the program headers are in memory, for the auxiliary vector
+	phdr, phnum uint64
+
+	// offset position independent executables are loaded at and the segment
+	// describing their dynamic section
+	bias    uint64
+	dynamic elf.ProgHeader
+
+	// the dynamic linker requested by the program, where it is loaded and
+	// where it starts
+	interp      string
+	interpBase  uint64
+	interpEntry uint64
+
+	// template for the thread-local storage of the program
+	tls elf.ProgHeader
 }
 
 // create a new emulator
 func NewEmulator(size uint) *Emulator {
 	return &Emulator{
-		Mmu: NewMmu(size),
-		files: map[int]*os.File{
-			0: os.Stdin,
-			1: os.Stdout,
-			2: os.Stderr,
-		},
+		Mmu:   NewMmu(size),
+		hooks: make(map[VirtAddr]func(*Emulator) error),
+		files: NewFileTable(NewMemFS(), os.Stdin, os.Stdout, os.Stderr),
 	}
 }
 
@@ -48,19 +88,74 @@ func (e *Emulator) setPC(addr uint64) {
 	e.SetReg(Pc, addr)
 }
 
-// create an identical copy of the emulator
+// create an identical copy of the emulator, the copy continues from the exact
+// point of execution the emulator is at.
 func (e Emulator) Fork() *Emulator {
-	return &Emulator{
-		Mmu:     e.Mmu.Fork(),
-		program: e.program,
-		files: map[int]*os.File{
-			0: os.Stdin,
-			1: os.Stdout,
-			2: os.Stderr,
-		},
+	fork := &Emulator{
+		Mmu:        e.Mmu.Fork(),
+		program:    e.program,
+		programBrk: e.programBrk,
+		initialBrk: e.initialBrk,
+		registers:  e.registers,
+		files:      e.files.Fork(),
+		icount:     e.icount,
+		misaligned: e.misaligned,
+		tidAddress: e.tidAddress,
+		hooks:      e.hooks,
+		callstack:  append([]uint64(nil), e.callstack...),
+	}
+	if e.san != nil {
+		fork.san = e.san.Fork()
+	}
+	return fork
+}
+
+// Reset restores a forked emulator to the state of the emulator it was forked
+// from, only memory modified since the fork is restored.
+func (e *Emulator) Reset(parent *Emulator) {
+	e.Mmu.Reset(parent.Mmu)
+	e.programBrk = parent.programBrk
+	e.initialBrk = parent.initialBrk
+	e.registers = parent.registers
+	e.icount = parent.icount
+	e.misaligned = parent.misaligned
+	e.tidAddress = parent.tidAddress
+	e.callstack = append(e.callstack[:0], parent.callstack...)
+	e.files.Reset(parent.files)
+	e.san = nil
+	if parent.san != nil {
+		e.san = parent.san.Fork()
 	}
 }
 
+// SetFS makes `fsys` the filesystem the program opens files from
+func (e *Emulator) SetFS(fsys FS) { e.files.fs = fsys }
+
+// BreakAt stops execution before the instruction at `pc` is executed
+func (e *Emulator) BreakAt(pc uint64) {
+	if e.breakpoints == nil {
+		e.breakpoints = make(map[VirtAddr]bool)
+	}
+	e.breakpoints[VirtAddr(pc)] = true
+}
+
+// BreakAfter stops execution once `icount` instructions have been executed
+func (e *Emulator) BreakAfter(icount uint64) { e.breakIcount = icount }
+
+// Hook runs `fn` instead of the instruction at `addr` whenever the program
+// counter reaches it. A hook standing in for a function returns through
+// hookReturn.
+func (e *Emulator) Hook(addr VirtAddr, fn func(*Emulator) error) {
+	e.hooks[addr] = fn
+}
+
+// hookReturn returns from a hooked function with `val` as the result
+func (e *Emulator) hookReturn(val uint64) {
+	e.RetVal(val)
+	e.SetReg(Pc, e.Reg(Ra))
+	e.trackCall(Zero, Ra, 0)
+}
+
 func max(a, b uint) uint {
 	if a > b {
 		return a
@@ -74,53 +169,117 @@ func (e *Emulator) loadSegments() error {
 	if err != nil {
 		return err
 	}
+	if err := e.mapSegments(fileContents, e.program.segments, e.program.bias); err != nil {
+		return err
+	}
 
-	for _, seg := range e.program.segments {
-		// set memory as writable
-		alignedSize := (seg.Memsz + seg.Align) &^ seg.Align
-		e.SetPermissions(VirtAddr(seg.Vaddr), uint(alignedSize), PERM_WRITE)
+	// relocations are applied while all segments are still writable, a
+	// dynamically linked program is relocated by its interpreter instead.
+	if e.program.interp == "" {
+		if err := e.relocate(fileContents); err != nil {
+			return err
+		}
+	}
+	e.demoteSegments(e.program.segments, e.program.bias)
+
+	//TODO(Joe):
+	// the current alloc is also the program break increase it before exectuting
+	// program
+	// And do we really need a program break?
+	e.programBrk = e.curAlloc
+	e.initialBrk = e.programBrk
+	// e.curAlloc = ((e.curAlloc + 0x1000) + 0xf) &^ 0xf
+
+	e.setPC(e.program.entry)
+	return nil
+}
+
+// pageSpan returns the page aligned region a segment loaded at `bias` covers
+func pageSpan(seg elf.ProgHeader, bias uint64) (VirtAddr, VirtAddr) {
+	start := (seg.Vaddr + bias) &^ (PAGE_SIZE - 1)
+	end := (seg.Vaddr + bias + seg.Memsz + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	return VirtAddr(start), VirtAddr(end)
+}
+
+// mapSegments writes the loadable segments in `contents` to memory `bias`
+// bytes from their addresses, leaving them writable.
+func (e *Emulator) mapSegments(contents []uint8, segments []elf.ProgHeader, bias uint64) error {
+	for _, seg := range segments {
+		vaddr := seg.Vaddr + bias
+
+		// set the pages of the segment as writable
+		start, end := pageSpan(seg, bias)
+		e.SetPermissions(start, uint(end-start), PERM_WRITE)
 
 		// write file contents into memory
-		if err := e.WriteFrom(VirtAddr(seg.Vaddr), fileContents[seg.Off:seg.Off+seg.Filesz]); err != nil {
+		if err := e.WriteFrom(VirtAddr(vaddr), contents[seg.Off:seg.Off+seg.Filesz]); err != nil {
 			return err
 		}
 
 		// fill-in any pads with zeros
 		if seg.Memsz > seg.Filesz {
 			pad := make([]uint8, seg.Memsz-seg.Filesz)
-			if err := e.WriteFrom(VirtAddr(seg.Vaddr+seg.Filesz), pad); err != nil {
+			if err := e.WriteFrom(VirtAddr(vaddr+seg.Filesz), pad); err != nil {
 				return err
 			}
 		}
-		// demote permissions to originals
-		e.SetPermissions(VirtAddr(seg.Vaddr), uint(alignedSize), Perm(seg.Flags))
 
-		// update curAlloc beyond all sections and 16-byte align it
-		e.curAlloc = VirtAddr(
-			max(uint(e.curAlloc), uint(seg.Vaddr+seg.Memsz+seg.Align)&^uint(seg.Align)),
-		)
+		// update curAlloc beyond all segments, on a page boundary
+		e.curAlloc = VirtAddr(max(uint(e.curAlloc), uint(end)))
 	}
+	return nil
+}
 
-	//TODO(Joe):
-	// the current alloc is also the program break increase it before exectuting
-	// program
-	// And do we really need a program break?
-	e.programBrk = e.curAlloc
-	// e.curAlloc = ((e.curAlloc + 0x1000) + 0xf) &^ 0xf
+// demoteSegments gives the pages of mapped segments their original
+// permissions, a page shared by segments gets the permissions of all of them.
+func (e *Emulator) demoteSegments(segments []elf.ProgHeader, bias uint64) {
+	perms := make(map[VirtAddr]Perm)
+	for _, seg := range segments {
+		start, end := pageSpan(seg, bias)
+		for page := start; page < end; page += PAGE_SIZE {
+			perms[page] |= Perm(seg.Flags) & (PERM_READ | PERM_WRITE | PERM_EXEC)
+		}
+	}
+	for page, perm := range perms {
+		e.SetPermissions(page, PAGE_SIZE, perm)
+	}
+}
 
-	e.setPC(e.program.entry)
-	return nil
+// allocPerm is the permission given to memory handed out to the program.
+// Unless uninitialized reads are allowed, memory is only readable after it has
+// been written to.
+func allocPerm() Perm {
+	if ALLOW_UNINIT_READ {
+		return PERM_READ | PERM_WRITE
+	}
+	return PERM_RAW | PERM_WRITE
 }
 
 // reserve space in memory for static and dynamic objects (stack and heap).
-func (e *Emulator) allocStackAndHeap() {
+// Below the stack is a guard region that catches the stack overflowing.
+func (e *Emulator) allocStackAndHeap() error {
 	// stack starts at a 16-byte address 255 steps away from last address.
 	e.setStack(VirtAddr((e.Len() - 0xff) &^ 0xf))
 	e.SetReg(Sp, uint64(e.Stack()))
+
+	if uint(e.Stack()) < STACK_SIZE+GUARD_SIZE ||
+		e.Stack()-VirtAddr(STACK_SIZE+GUARD_SIZE) < e.curAlloc {
+		return fmt.Errorf("stack of %#x bytes does not fit in memory", STACK_SIZE)
+	}
+	bottom := e.Stack() - VirtAddr(STACK_SIZE)
+
 	// calculate what to add to sp to get to end of memory.
-	end := uint(e.Len()-int(e.Stack()-STACK_SIZE)) - 1
-	e.SetPermissions(e.Stack()-STACK_SIZE, end, PERM_READ|PERM_WRITE)
-	e.setHeap(e.Allocate(HEAP_SIZE))
+	end := uint(e.Len()-int(bottom)) - 1
+	e.SetPermissions(bottom, end, allocPerm())
+	e.TrackAllocation(bottom, end, "stack")
+	e.setGuard(bottom - GUARD_SIZE)
+
+	e.setHeap(e.AllocatePerms(HEAP_SIZE, allocPerm()))
+	if e.Heap() == 0 {
+		return fmt.Errorf("heap of %#x bytes does not fit in memory", HEAP_SIZE)
+	}
+	e.TrackAllocation(e.Heap(), HEAP_SIZE, "heap")
+	return nil
 }
 
 // This is what a program looks like in memory
@@ -150,13 +309,17 @@ func (e *Emulator) allocStackAndHeap() {
 //
 // MapProgram maps the executable elf file into memory to create a process image.
 // It also sets the heap and stack start points basically setting everything up
-// for execution to begin. it does the work of execv
-// int execv(const char *pathname, char *const argv[]);
-func (e *Emulator) MapProgram(path string, args []string) error {
-	bin, err := elf.Open(path)
+// for execution to begin. it does the work of execve
+// int execve(const char *pathname, char *const argv[], char *const envp[]);
+func (e *Emulator) MapProgram(path string, args []string, env []string) error {
+	contents, err := os.ReadFile(path)
 	if err != nil {
 		return err
 	}
+	bin, err := elf.NewFile(bytes.NewReader(contents))
+	if err != nil {
+		return LoaderError{path, err.Error()}
+	}
 	_, name := filepath.Split(path)
 
 	prog := ElfBinary{
@@ -165,14 +328,39 @@ func (e *Emulator) MapProgram(path string, args []string) error {
 		args:     args,
 		entry:    bin.FileHeader.Entry,
 		segments: make([]elf.ProgHeader, 0, len(bin.Progs)),
+		symbols:  funcSymbols(bin),
 	}
 
 	for _, hdr := range bin.Progs {
 		typ := hdr.ProgHeader.Type
 		if typ == elf.PT_LOAD {
 			prog.segments = append(prog.segments, hdr.ProgHeader)
+		} else if typ == elf.PT_DYNAMIC {
+			prog.dynamic = hdr.ProgHeader
+		} else if typ == elf.PT_TLS {
+			prog.tls = hdr.ProgHeader
+		} else if typ == elf.PT_INTERP {
+			interp, err := io.ReadAll(hdr.Open())
+			if err != nil {
+				return err
+			}
+			prog.interp = string(bytes.TrimRight(interp, "\x00"))
 		}
 	}
+	prog.phdr, prog.phnum = programHeaders(bin, contents)
+
+	var bias uint64
+	if bin.Type == elf.ET_DYN {
+		bias = PIE_BASE
+	}
+	if err = e.validateElf(path, bin, contents, prog.segments, bias); err != nil {
+		return err
+	}
+
+	// position independent executables are linked at 0 and moved up
+	if bin.Type == elf.ET_DYN {
+		prog.rebase(PIE_BASE)
+	}
 
 	if DUMP_ELF_INFO {
 		fmt.Println("")
@@ -183,24 +371,34 @@ func (e *Emulator) MapProgram(path string, args []string) error {
 	if err = e.loadSegments(); err != nil {
 		return err
 	}
-	e.allocStackAndHeap()
+	if prog.interp != "" {
+		if err = e.loadInterp(); err != nil {
+			return err
+		}
+	}
+	if err = e.allocStackAndHeap(); err != nil {
+		return err
+	}
+	if prog.tls.Type == elf.PT_TLS {
+		if err = e.setupTLS(); err != nil {
+			return err
+		}
+	}
+	if SANITIZE_HEAP {
+		e.hookSanitizer()
+	}
 
 	// insert name of executable as first argument in vector
-	args = append(args[:0], append([]string{e.program.name}, args[0:]...)...)
-	vec := nullTerminateArgs(args)
-	size := (len(vec) + 0xf) &^ 0xf
-	argv := VirtAddr(e.Reg(Sp) - uint64(size))
-	if err := e.WriteFrom(argv, vec); err != nil {
+	argv := append([]string{e.program.name}, args...)
+	if err = e.setupStack(argv, env); err != nil {
 		return err
 	}
 
-	// set up the stack for the main function
-	// int main(int argc, char *argv[], char *envp[])
-	// lets ignore all the errors because we can!
-	_ = push(e, uint64(0))            // evnp
-	_ = push(e, uint64(argv))         // argv
-	err = push(e, int32(len(args)+1)) // argc
-	return err
+	// everything above the initial stack pointer is set up by the "kernel" and
+	// counts as initialized memory for the program.
+	sp := VirtAddr(e.Reg(Sp))
+	e.SetPermissions(sp, uint(e.Len())-uint(sp), PERM_READ|PERM_WRITE)
+	return nil
 }
 
 // push is a routine for pushing values onto the stack
@@ -214,14 +412,13 @@ func push[T Primitive](emu *Emulator, val T) error {
 	return nil
 }
 
-// null terminate arguments variables for the program
-func nullTerminateArgs(args []string) []byte {
-	var strs []byte
-	for _, str := range args {
-		s := append([]byte(str), 0)
-		strs = append(strs, s...)
+// jump moves the program counter to `target` if it is suitably aligned
+func (e *Emulator) jump(target uint64) error {
+	if err := e.checkAlign(VirtAddr(target), INST_ALIGN, ALIGN_JUMP); err != nil {
+		return err
 	}
-	return strs
+	e.SetReg(Pc, target)
+	return nil
 }
 
 // Set the specified registers value
@@ -285,6 +482,56 @@ func (e EmuExit) Error() string {
 	)
 }
 
+// Breakpoint signals that execution stopped at a requested point, calling
+// Run again continues from there.
+type Breakpoint struct{ pc, icount uint64 }
+
+func (b Breakpoint) Error() string {
+	return fmt.Sprintf("breakpoint at pc %#x after %d instructions", b.pc, b.icount)
+}
+
+// IllegalInstruction is the exit cause of an instruction the emulator can't
+// execute, `name` is set for instructions it knows but doesn't support
+type IllegalInstruction struct {
+	inst uint32
+	pc   uint64
+	name string
+}
+
+func (i IllegalInstruction) Error() string {
+	if i.name != "" {
+		return fmt.Sprintf("IllegalInstruction{inst: %#08x (%s), pc: %#x}", i.inst, i.name, i.pc)
+	}
+	return fmt.Sprintf("IllegalInstruction{inst: %#08x, pc: %#x}", i.inst, i.pc)
+}
+
+// Ebreak is the exit cause when the program executes an ebreak with no
+// debugger to hand it to
+type Ebreak struct{ pc uint64 }
+
+func (b Ebreak) Error() string { return fmt.Sprintf("Ebreak{pc: %#x}", b.pc) }
+
+// StackOverflow is the exit cause when the program's stack grows into the
+// guard region below it
+type StackOverflow struct {
+	addr VirtAddr
+	sp   uint64
+	pc   uint64
+}
+
+func (s StackOverflow) Error() string {
+	return fmt.Sprintf("StackOverflow{addr: %#x, sp: %#x, pc: %#x}", s.addr, s.sp, s.pc)
+}
+
+// memFault gives memory errors raised by loads and stores a more specific
+// cause when one is known
+func (e *Emulator) memFault(err error) error {
+	if merr, ok := err.(MMUError); ok && merr.typ == ErrPerms && e.InGuard(merr.addr, merr.size) {
+		return StackOverflow{merr.addr, e.Reg(Sp), e.Reg(Pc)}
+	}
+	return e.classify(err)
+}
+
 // Done signals the emulator when a program pauses/stops execution.
 type Done struct{ status int }
 
@@ -295,12 +542,34 @@ func (d Done) Error() string {
 // Run is the fetch - decode - execute loop (it gets the next instruction,
 // decodes it and performs the operations encoded into the instruction)
 func (e *Emulator) Run() (err error) {
-	for {
+	for resumed := true; ; resumed = false {
+		// don't stop on the breakpoint execution is resuming from
+		if !resumed && (e.breakpoints[VirtAddr(e.Reg(Pc))] ||
+			(e.breakIcount != 0 && e.icount == e.breakIcount)) {
+			return EmuExit{e.String(), Breakpoint{e.Reg(Pc), e.icount}, 0}
+		}
+
+		// most programs run without hooks, skip the lookup for them
+		if len(e.hooks) != 0 {
+			if hook, ok := e.hooks[VirtAddr(e.Reg(Pc))]; ok {
+				pc := e.Reg(Pc)
+				if err := hook(e); err != nil {
+					return EmuExit{e.String(), err, 0}
+				}
+				if hit, ok := e.TakeWatchpointHit(); ok {
+					hit.pc = pc
+					return EmuExit{e.String(), hit, 0}
+				}
+				continue
+			}
+		}
+
 		inst, opcode, err := e.NextInstAndOpcode()
 		pc := e.Reg(Pc)
 		if err != nil {
 			return EmuExit{e.String(), err, opcode}
 		}
+		e.icount++
 
 		if VERBOSE_PC_OPCODE {
 			fmt.Printf("opcode: %#08b, pc: %#x\n", opcode, pc)
@@ -318,11 +587,13 @@ func (e *Emulator) Run() (err error) {
 		case 0b0000011:
 			// itype - memory loads
 			if err := e.decodeItypeLoads(inst); err != nil {
-				return EmuExit{e.String(), err, opcode}
+				return EmuExit{e.String(), e.memFault(err), opcode}
 			}
 		case 0b0100011:
 			// stype - memory stores
-			e.decodeStypeStore(inst)
+			if err := e.decodeStypeStore(inst); err != nil {
+				return EmuExit{e.String(), e.memFault(err), opcode}
+			}
 		case 0b0110111:
 			// Utype
 			// LUI
@@ -337,16 +608,23 @@ func (e *Emulator) Run() (err error) {
 			// Jtype
 			// JAL
 			inst := Decode(inst, Jtype{}).(Jtype)
+			if err := e.jump(uint64(int64(inst.imm)) + pc); err != nil {
+				return EmuExit{e.String(), err, opcode}
+			}
+			e.trackCall(inst.rd, Zero, pc)
 			e.SetReg(inst.rd, pc+4)
-			e.SetReg(Pc, uint64(int64(inst.imm))+pc)
 			continue
 		case 0b1100111:
 			// Itype
 			// JALR
 			inst := Decode(inst, Itype{}).(Itype)
-			target := e.Reg(inst.rs1) + uint64(int64(inst.imm))
+			// the lowest bit of the target is always cleared
+			target := (e.Reg(inst.rs1) + uint64(int64(inst.imm))) &^ 1
+			if err := e.jump(target); err != nil {
+				return EmuExit{e.String(), err, opcode}
+			}
+			e.trackCall(inst.rd, inst.rs1, pc)
 			e.SetReg(inst.rd, pc+4)
-			e.SetReg(Pc, target)
 			continue
 		case 0b1100011:
 			// Btype
@@ -355,49 +633,32 @@ func (e *Emulator) Run() (err error) {
 			rs1 := e.Reg(inst.rs1)
 			rs2 := e.Reg(inst.rs2)
 
+			var taken bool
 			switch inst.funct3 {
 			case 0x0:
 				// BEQ
-				if rs1 == rs2 {
-					simm := uint64(int64(inst.imm)) + pc
-					e.SetReg(Pc, simm)
-					continue
-				}
+				taken = rs1 == rs2
 			case 0x1:
 				// BNE
-				if rs1 != rs2 {
-					simm := uint64(int64(inst.imm)) + pc
-					e.SetReg(Pc, simm)
-					continue
-				}
+				taken = rs1 != rs2
 			case 0x2:
 				// BLT
-				if int64(rs1) < int64(rs2) {
-					simm := uint64(int64(inst.imm)) + pc
-					e.SetReg(Pc, simm)
-					continue
-				}
+				taken = int64(rs1) < int64(rs2)
 			case 0x4:
 				// BGE
-				if int64(rs1) >= int64(rs2) {
-					simm := uint64(int64(inst.imm)) + pc
-					e.SetReg(Pc, simm)
-					continue
-				}
+				taken = int64(rs1) >= int64(rs2)
 			case 0x6:
 				// BLTU
-				if rs1 < rs2 {
-					simm := uint64(int64(inst.imm)) + pc
-					e.SetReg(Pc, uint64(simm))
-					continue
-				}
+				taken = rs1 < rs2
 			case 0x7:
 				// BGEU
-				if rs1 >= rs2 {
-					simm := uint64(inst.imm) + pc
-					e.SetReg(Pc, simm)
-					continue
+				taken = rs1 >= rs2
+			}
+			if taken {
+				if err := e.jump(uint64(int64(inst.imm)) + pc); err != nil {
+					return EmuExit{e.String(), err, opcode}
 				}
+				continue
 			}
 		case 0b0011011:
 			// itype 32bit register-immediate arithmetic
@@ -407,20 +668,25 @@ func (e *Emulator) Run() (err error) {
 			e.decodeRtype32RegArith(inst)
 		case 0b0001111:
 			// FENCE
-			return EmuExit{e.String(), fmt.Errorf("fence"), opcode}
+			return EmuExit{e.String(), IllegalInstruction{inst, pc, "fence"}, opcode}
 		case 0b1110011:
 			if inst == 0b00000000000000000000000001110011 {
 				// ECALL
 				if err := e.TrapIntoSystem(); err != nil {
 					return EmuExit{e.String(), err, opcode}
 				}
-			} else if inst == 0b0000000000010000000000000001110011 {
+			} else if inst == 0b00000000000100000000000001110011 {
 				// EBREAK
-				return EmuExit{e.String(), fmt.Errorf("ebreak"), opcode}
+				return EmuExit{e.String(), Ebreak{pc}, opcode}
 			}
 		default:
-			return fmt.Errorf("unhandled opcode: %#b", opcode)
+			return EmuExit{e.String(), IllegalInstruction{inst, pc, ""}, opcode}
 		}
 		e.IncPc()
+
+		if hit, ok := e.TakeWatchpointHit(); ok {
+			hit.pc = pc
+			return EmuExit{e.String(), hit, opcode}
+		}
 	}
 }
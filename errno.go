@@ -0,0 +1,106 @@
+// linux error numbers - syscalls fail by returning -errno in a0.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"syscall"
+)
+
+// Errno is a Linux error number as seen by the program, independent of the
+// host the emulator runs on
+type Errno uint64
+
+const (
+	EPERM        Errno = 1
+	ENOENT       Errno = 2
+	EIO          Errno = 5
+	EBADF        Errno = 9
+	EAGAIN       Errno = 11
+	ENOMEM       Errno = 12
+	EACCES       Errno = 13
+	EFAULT       Errno = 14
+	EBUSY        Errno = 16
+	EEXIST       Errno = 17
+	EXDEV        Errno = 18
+	ENODEV       Errno = 19
+	ENOTDIR      Errno = 20
+	EISDIR       Errno = 21
+	EINVAL       Errno = 22
+	EMFILE       Errno = 24
+	ENOTTY       Errno = 25
+	EFBIG        Errno = 27
+	ENOSPC       Errno = 28
+	ESPIPE       Errno = 29
+	EROFS        Errno = 30
+	ERANGE       Errno = 34
+	ENAMETOOLONG Errno = 36
+	ENOSYS       Errno = 38
+	ENOTEMPTY    Errno = 39
+	ELOOP        Errno = 40
+)
+
+var errnoNames = map[Errno]string{
+	EPERM: "EPERM", ENOENT: "ENOENT", EIO: "EIO", EBADF: "EBADF",
+	EAGAIN: "EAGAIN", ENOMEM: "ENOMEM", EACCES: "EACCES", EFAULT: "EFAULT",
+	EBUSY: "EBUSY", EEXIST: "EEXIST", EXDEV: "EXDEV", ENODEV: "ENODEV",
+	ENOTDIR: "ENOTDIR", EISDIR: "EISDIR", EINVAL: "EINVAL", EMFILE: "EMFILE",
+	ENOTTY: "ENOTTY", EFBIG: "EFBIG", ENOSPC: "ENOSPC", ESPIPE: "ESPIPE",
+	EROFS: "EROFS", ERANGE: "ERANGE", ENAMETOOLONG: "ENAMETOOLONG",
+	ENOSYS: "ENOSYS", ENOTEMPTY: "ENOTEMPTY", ELOOP: "ELOOP",
+}
+
+func (e Errno) Error() string {
+	if name, ok := errnoNames[e]; ok {
+		return name
+	}
+	return fmt.Sprintf("Errno(%d)", uint64(e))
+}
+
+// host errors that have a Linux equivalent, checked in order. Some errno
+// values match more than one fs error so they come first.
+var hostErrnos = []struct {
+	err   error
+	errno Errno
+}{
+	{syscall.EISDIR, EISDIR},
+	{syscall.ENOTDIR, ENOTDIR},
+	{syscall.ENOTEMPTY, ENOTEMPTY},
+	{syscall.ELOOP, ELOOP},
+	{syscall.ENAMETOOLONG, ENAMETOOLONG},
+	{syscall.EROFS, EROFS},
+	{syscall.ENOSPC, ENOSPC},
+	{syscall.EXDEV, EXDEV},
+	{syscall.EBADF, EBADF},
+	{syscall.ESPIPE, ESPIPE},
+	{fs.ErrNotExist, ENOENT},
+	{fs.ErrExist, EEXIST},
+	{fs.ErrPermission, EACCES},
+	{fs.ErrClosed, EBADF},
+	{fs.ErrInvalid, EINVAL},
+	{syscall.EINVAL, EINVAL},
+}
+
+// toErrno is the error number the program sees for `err`
+func toErrno(err error) Errno {
+	var errno Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	for _, h := range hostErrnos {
+		if errors.Is(err, h.err) {
+			return h.errno
+		}
+	}
+	return EIO
+}
+
+// retErrno returns `val` from a syscall, or -errno when `err` is set
+func (e *Emulator) retErrno(val uint64, err error) {
+	if err != nil {
+		e.RetVal(-uint64(toErrno(err)))
+		return
+	}
+	e.RetVal(val)
+}
@@ -0,0 +1,221 @@
+// host filesystem - files of a directory on the host, the program sees the
+// directory as its root and can't reach anything outside of it.
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// HostFS passes file operations through to the directory `root` on the host
+type HostFS struct {
+	root string
+}
+
+// NewHostFS creates a filesystem rooted at the host directory `root`
+func NewHostFS(root string) (*HostFS, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sandbox", Path: root, Err: ENOTDIR}
+	}
+	return &HostFS{root}, nil
+}
+
+// within reports whether the host path `p` is inside the sandbox
+func (h *HostFS) within(p string) bool {
+	return p == h.root || strings.HasPrefix(p, h.root+string(filepath.Separator))
+}
+
+// hostPath is the path on the host of the program's `name`. Symbolic links
+// are followed to make sure they don't lead out of the sandbox, the file itself
+// is left alone unless `follow` is set.
+func (h *HostFS) hostPath(name string, follow bool) (string, error) {
+	p := filepath.Join(h.root, filepath.FromSlash(path.Clean("/"+name)))
+	if p == h.root {
+		return p, nil
+	}
+
+	// the file itself may not exist yet, its directory has to
+	dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return "", err
+	}
+	if !h.within(dir) {
+		return "", EACCES
+	}
+	p = filepath.Join(dir, filepath.Base(p))
+	if !follow {
+		return p, nil
+	}
+	return h.follow(p)
+}
+
+// follow resolves the symbolic links at the host path `p`, whose directory is
+// known to be in the sandbox. Links may point at files that don't exist yet,
+// those have to be in the sandbox too as following the link creates them.
+func (h *HostFS) follow(p string) (string, error) {
+	for hops := 0; ; hops++ {
+		info, err := os.Lstat(p)
+		if errors.Is(err, fs.ErrNotExist) || err == nil && info.Mode()&fs.ModeSymlink == 0 {
+			return p, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if hops == MAX_SYMLINKS {
+			return "", ELOOP
+		}
+		target, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(p), target)
+		}
+		dir, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return "", err
+		}
+		if !h.within(dir) {
+			return "", EACCES
+		}
+		p = filepath.Join(dir, filepath.Base(target))
+	}
+}
+
+// hostFlags translates Linux open flags to the host's. Appending is done by
+// the file table.
+func hostFlags(flags int) int {
+	var host int
+	switch flags & O_ACCMODE {
+	case O_RDONLY:
+		host = os.O_RDONLY
+	case O_WRONLY:
+		host = os.O_WRONLY
+	default:
+		host = os.O_RDWR
+	}
+	for _, f := range []struct{ linux, host int }{
+		{O_CREAT, os.O_CREATE}, {O_EXCL, os.O_EXCL}, {O_TRUNC, os.O_TRUNC},
+	} {
+		if flags&f.linux != 0 {
+			host |= f.host
+		}
+	}
+	return host
+}
+
+func (h *HostFS) OpenFile(name string, flags int, mode fs.FileMode) (File, error) {
+	p, err := h.hostPath(name, flags&O_NOFOLLOW == 0)
+	if err != nil {
+		return nil, err
+	}
+	if flags&O_NOFOLLOW != 0 {
+		if info, err := os.Lstat(p); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return nil, ELOOP
+		}
+	}
+	file, err := os.OpenFile(p, hostFlags(flags), mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	if flags&O_DIRECTORY != 0 {
+		info, err := file.Stat()
+		if err == nil && !info.IsDir() {
+			err = ENOTDIR
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return file, nil
+}
+
+func (h *HostFS) Stat(name string, follow bool) (fs.FileInfo, error) {
+	p, err := h.hostPath(name, follow)
+	if err != nil {
+		return nil, err
+	}
+	if follow {
+		return os.Stat(p)
+	}
+	return os.Lstat(p)
+}
+
+func (h *HostFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := h.hostPath(name, true)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (h *HostFS) Mkdir(name string, mode fs.FileMode) error {
+	p, err := h.hostPath(name, false)
+	if err != nil {
+		return err
+	}
+	// the host isn't trusted to leave a dangling link alone
+	if _, err := os.Lstat(p); err == nil {
+		return EEXIST
+	}
+	return os.Mkdir(p, mode.Perm())
+}
+
+func (h *HostFS) Remove(name string, dir bool) error {
+	p, err := h.hostPath(name, false)
+	if err != nil {
+		return err
+	}
+	if p == h.root {
+		return EBUSY
+	}
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	if dir && !info.IsDir() {
+		return ENOTDIR
+	}
+	if !dir && info.IsDir() {
+		return EISDIR
+	}
+	return os.Remove(p)
+}
+
+func (h *HostFS) Rename(from, to string) error {
+	src, err := h.hostPath(from, false)
+	if err != nil {
+		return err
+	}
+	dst, err := h.hostPath(to, false)
+	if err != nil {
+		return err
+	}
+	if src == h.root || dst == h.root {
+		return EBUSY
+	}
+	// links are renamed and not followed, those leading out of the sandbox
+	// are refused all the same
+	for _, p := range []string{src, dst} {
+		if _, err := h.follow(p); err != nil {
+			return err
+		}
+	}
+	return os.Rename(src, dst)
+}
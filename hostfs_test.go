@@ -0,0 +1,43 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHostFSNoFollow(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "target"), []uint8("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewHostFS(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		flags int
+		want  error
+	}{
+		{"/link", O_RDONLY, nil},
+		{"/target", O_RDONLY | O_NOFOLLOW, nil},
+		{"/link", O_RDONLY | O_NOFOLLOW, ELOOP},
+		{"/link", O_WRONLY | O_TRUNC | O_NOFOLLOW, ELOOP},
+	} {
+		file, err := fsys.OpenFile(tc.name, tc.flags, 0)
+		if err != tc.want {
+			t.Errorf("open %s with flags %#x returned %v, want %v", tc.name, tc.flags, err, tc.want)
+		}
+		if file != nil {
+			file.Close()
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "target")); string(data) != "data" {
+		t.Fatalf("target holds %q after refusing to follow the link", data)
+	}
+}
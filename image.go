@@ -0,0 +1,281 @@
+// raw images - flat binaries, Intel HEX and Motorola S-record files loaded at a
+// fixed address, as produced for bootloaders and bare metal programs.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageFormat is the format of the program file
+type ImageFormat uint8
+
+const (
+	IMAGE_ELF  ImageFormat = iota // elf executable
+	IMAGE_RAW                     // flat binary
+	IMAGE_IHEX                    // Intel HEX
+	IMAGE_SREC                    // Motorola S-record
+)
+
+func (f ImageFormat) String() string {
+	switch f {
+	case IMAGE_ELF:
+		return "elf"
+	case IMAGE_RAW:
+		return "raw"
+	case IMAGE_IHEX:
+		return "ihex"
+	case IMAGE_SREC:
+		return "srec"
+	}
+	return fmt.Sprintf("ImageFormat(%d)", uint8(f))
+}
+
+func (f *ImageFormat) Set(val string) error {
+	switch val {
+	case "elf":
+		*f = IMAGE_ELF
+	case "raw", "bin":
+		*f = IMAGE_RAW
+	case "ihex", "hex":
+		*f = IMAGE_IHEX
+	case "srec", "s19", "s28", "s37":
+		*f = IMAGE_SREC
+	default:
+		return fmt.Errorf("unknown image format %q", val)
+	}
+	return nil
+}
+
+// permFlag is a permission given on the command line as a combination of
+// r, w and x
+type permFlag Perm
+
+func (p *permFlag) String() string {
+	var s strings.Builder
+	for _, c := range []struct {
+		perm Perm
+		char byte
+	}{{PERM_READ, 'r'}, {PERM_WRITE, 'w'}, {PERM_EXEC, 'x'}} {
+		if Perm(*p)&c.perm != 0 {
+			s.WriteByte(c.char)
+		}
+	}
+	return s.String()
+}
+
+func (p *permFlag) Set(val string) error {
+	var perm Perm
+	for _, c := range val {
+		switch c {
+		case 'r':
+			perm |= PERM_READ
+		case 'w':
+			perm |= PERM_WRITE
+		case 'x':
+			perm |= PERM_EXEC
+		default:
+			return fmt.Errorf("unknown permission %q in %q", c, val)
+		}
+	}
+	*p = permFlag(perm)
+	return nil
+}
+
+// imageChunk is a run of bytes at an offset from the load address
+type imageChunk struct {
+	addr uint64
+	data []uint8
+}
+
+// MapImage loads the raw image at `path` at `base` with permissions `perms`
+// and starts execution at `entry`. An entry of zero means the start address
+// recorded in the image, or the base address when there is none.
+func (e *Emulator) MapImage(path string, format ImageFormat, base VirtAddr,
+	perms Perm, entry uint64) error {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var (
+		chunks []imageChunk
+		start  uint64
+		ok     bool
+	)
+	switch format {
+	case IMAGE_RAW:
+		chunks = []imageChunk{{0, contents}}
+	case IMAGE_IHEX:
+		chunks, start, ok, err = parseIntelHex(contents)
+	case IMAGE_SREC:
+		chunks, start, ok, err = parseSRecord(contents)
+	default:
+		return LoaderError{path, fmt.Sprintf("%s is not a raw image format", format)}
+	}
+	if err != nil {
+		return LoaderError{path, err.Error()}
+	}
+	if len(chunks) == 0 {
+		return LoaderError{path, "image is empty"}
+	}
+
+	for _, c := range chunks {
+		addr := uint64(base) + c.addr
+		end := addr + uint64(len(c.data))
+		if addr < uint64(base) || end < addr || end > uint64(e.size) {
+			return LoaderError{path, fmt.Sprintf("data at [%#x, %#x) does not fit in %#x bytes of memory",
+				addr, end, e.size)}
+		}
+		e.SetPermissions(VirtAddr(addr), uint(len(c.data)), PERM_WRITE)
+		if err := e.WriteFrom(VirtAddr(addr), c.data); err != nil {
+			return err
+		}
+		e.SetPermissions(VirtAddr(addr), uint(len(c.data)), perms)
+
+		end = (end + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+		e.curAlloc = VirtAddr(max(uint(e.curAlloc), uint(end)))
+	}
+
+	if entry == 0 {
+		entry = uint64(base)
+		if ok {
+			entry += start
+		}
+	}
+	_, name := filepath.Split(path)
+	e.program = ElfBinary{name: name, path: path, entry: entry}
+	e.programBrk = e.curAlloc
+	e.initialBrk = e.programBrk
+	e.setPC(entry)
+	return e.allocStackAndHeap()
+}
+
+// parseIntelHex decodes an Intel HEX file
+//
+//	:LLAAAATT<data>CC
+//
+// LL data bytes at address AAAA of record type TT, CC makes the sum of all
+// bytes zero.
+func parseIntelHex(contents []uint8) (chunks []imageChunk, start uint64, ok bool, err error) {
+	var upper uint64
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != ':' {
+			return nil, 0, false, fmt.Errorf("line %d: record does not start with ':'", n)
+		}
+		rec := make([]uint8, hex.DecodedLen(len(line)-1))
+		if _, err := hex.Decode(rec, line[1:]); err != nil {
+			return nil, 0, false, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(rec) < 5 || len(rec) != int(rec[0])+5 {
+			return nil, 0, false, fmt.Errorf("line %d: bad record length", n)
+		}
+		var sum uint8
+		for _, b := range rec {
+			sum += b
+		}
+		if sum != 0 {
+			return nil, 0, false, fmt.Errorf("line %d: bad checksum", n)
+		}
+
+		addr := uint64(rec[1])<<8 | uint64(rec[2])
+		data := rec[4 : len(rec)-1]
+		var field uint64
+		for _, b := range data {
+			field = field<<8 | uint64(b)
+		}
+		switch typ := rec[3]; {
+		case typ == 0x00: // data
+			chunks = append(chunks, imageChunk{upper + addr, data})
+		case typ == 0x01: // end of file
+			return chunks, start, ok, nil
+		case (typ == 0x02 || typ == 0x04) && len(data) != 2,
+			(typ == 0x03 || typ == 0x05) && len(data) != 4:
+			return nil, 0, false, fmt.Errorf("line %d: bad record length", n)
+		case typ == 0x02: // extended segment address
+			upper = field << 4
+		case typ == 0x03: // start segment address, CS:IP
+			start, ok = (field>>16)<<4+field&0xffff, true
+		case typ == 0x04: // extended linear address
+			upper = field << 16
+		case typ == 0x05: // start linear address
+			start, ok = field, true
+		default:
+			return nil, 0, false, fmt.Errorf("line %d: unknown record type %#x", n, typ)
+		}
+	}
+	return chunks, start, ok, scanner.Err()
+}
+
+// parseSRecord decodes a Motorola S-record file
+//
+//	STLL<address><data>CC
+//
+// T is the record type, LL the number of bytes that follow and CC the ones'
+// complement of the low byte of their sum.
+func parseSRecord(contents []uint8) (chunks []imageChunk, start uint64, ok bool, err error) {
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if len(line) < 2 || line[0] != 'S' {
+			return nil, 0, false, fmt.Errorf("line %d: record does not start with 'S'", n)
+		}
+		typ := line[1]
+		rec := make([]uint8, hex.DecodedLen(len(line)-2))
+		if _, err := hex.Decode(rec, line[2:]); err != nil {
+			return nil, 0, false, fmt.Errorf("line %d: %w", n, err)
+		}
+		if len(rec) < 1 || len(rec) != int(rec[0])+1 {
+			return nil, 0, false, fmt.Errorf("line %d: bad record length", n)
+		}
+		var sum uint8
+		for _, b := range rec[:len(rec)-1] {
+			sum += b
+		}
+		if ^sum != rec[len(rec)-1] {
+			return nil, 0, false, fmt.Errorf("line %d: bad checksum", n)
+		}
+
+		// size of the address field of each record type
+		var width int
+		switch typ {
+		case '0', '1', '5', '9':
+			width = 2
+		case '2', '6', '8':
+			width = 3
+		case '3', '7':
+			width = 4
+		default:
+			return nil, 0, false, fmt.Errorf("line %d: unknown record type S%c", n, typ)
+		}
+		if len(rec) < width+2 {
+			return nil, 0, false, fmt.Errorf("line %d: bad record length", n)
+		}
+		var addr uint64
+		for _, b := range rec[1 : 1+width] {
+			addr = addr<<8 | uint64(b)
+		}
+		data := rec[1+width : len(rec)-1]
+
+		switch typ {
+		case '1', '2', '3': // data
+			chunks = append(chunks, imageChunk{addr, data})
+		case '7', '8', '9': // start address, ends the file
+			return chunks, addr, true, nil
+		}
+	}
+	return chunks, 0, false, scanner.Err()
+}
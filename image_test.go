@@ -0,0 +1,92 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// imageCase is a raw image and what decoding it gives
+type imageCase struct {
+	name   string
+	lines  []string
+	chunks []imageChunk
+	start  uint64
+	ok     bool
+	err    bool
+}
+
+// testImageParser runs `parse` on every case
+func testImageParser(t *testing.T, parse func([]uint8) ([]imageChunk, uint64, bool, error), cases []imageCase) {
+	t.Helper()
+	for _, tc := range cases {
+		chunks, start, ok, err := parse([]uint8(strings.Join(tc.lines, "\n")))
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: no error", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(chunks, tc.chunks) {
+			t.Errorf("%s: chunks %v, want %v", tc.name, chunks, tc.chunks)
+		}
+		if start != tc.start || ok != tc.ok {
+			t.Errorf("%s: start %#x, %v, want %#x, %v", tc.name, start, ok, tc.start, tc.ok)
+		}
+	}
+}
+
+func TestParseIntelHex(t *testing.T) {
+	data := []uint8{1, 2, 3, 4}
+	testImageParser(t, parseIntelHex, []imageCase{
+		{name: "data", lines: []string{":0400100001020304E2", ":00000001FF"},
+			chunks: []imageChunk{{0x10, data}}},
+		{name: "records after the end", lines: []string{":00000001FF", ":0400100001020304E2"}},
+		{name: "extended linear address", lines: []string{":020000040001F9", ":0400100001020304E2"},
+			chunks: []imageChunk{{0x10010, data}}},
+		{name: "extended segment address", lines: []string{":020000021000EC", ":0400100001020304E2"},
+			chunks: []imageChunk{{0x10010, data}}},
+		{name: "start linear address", lines: []string{":0400000500001234B1"},
+			start: 0x1234, ok: true},
+		{name: "start segment address", lines: []string{":0400000301000020D8"},
+			start: 0x1020, ok: true},
+		{name: "bad checksum", lines: []string{":0400100001020304E3"}, err: true},
+		{name: "bad length", lines: []string{":0500100001020304E2"}, err: true},
+		{name: "short address record", lines: []string{":0100000401FA"}, err: true},
+		{name: "unknown record type", lines: []string{":00000006FA"}, err: true},
+		{name: "no colon", lines: []string{"0400100001020304E2"}, err: true},
+		{name: "not hex", lines: []string{":04001000010203XXE2"}, err: true},
+	})
+}
+
+func TestParseSRecord(t *testing.T) {
+	testImageParser(t, parseSRecord, []imageCase{
+		{name: "16-bit address", lines: []string{"S0060000686472BB", "S1061000010203E3", "S9031000EC"},
+			chunks: []imageChunk{{0x1000, []uint8{1, 2, 3}}}, start: 0x1000, ok: true},
+		{name: "24-bit address", lines: []string{"S206012345AABB2B", "S80401234592"},
+			chunks: []imageChunk{{0x12345, []uint8{0xaa, 0xbb}}}, start: 0x12345, ok: true},
+		{name: "32-bit address", lines: []string{"S30612345678CC19", "S70512345678E6"},
+			chunks: []imageChunk{{0x12345678, []uint8{0xcc}}}, start: 0x12345678, ok: true},
+		{name: "no start address", lines: []string{"S1061000010203E3"},
+			chunks: []imageChunk{{0x1000, []uint8{1, 2, 3}}}},
+		{name: "bad checksum", lines: []string{"S1061000010203E4"}, err: true},
+		{name: "bad length", lines: []string{"S1071000010203E3"}, err: true},
+		{name: "unknown record type", lines: []string{"S4030000FC"}, err: true},
+		{name: "no S", lines: []string{"1061000010203E3"}, err: true},
+	})
+}
+
+func TestImageFormatString(t *testing.T) {
+	for f, want := range map[ImageFormat]string{
+		IMAGE_ELF: "elf", IMAGE_RAW: "raw", IMAGE_IHEX: "ihex", IMAGE_SREC: "srec",
+		ImageFormat(9): "ImageFormat(9)",
+	} {
+		if got := f.String(); got != want {
+			t.Errorf("ImageFormat(%d) is %q, want %q", f, got, want)
+		}
+	}
+}
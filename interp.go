@@ -0,0 +1,62 @@
+// dynamic linking - programs that name an interpreter (the dynamic linker)
+// are started through it, it loads and links the program's libraries.
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// loadInterp maps the program's interpreter from the sysroot above everything
+// loaded so far and makes it the first thing to run. The interpreter relocates
+// itself and the program.
+func (e *Emulator) loadInterp() error {
+	path := filepath.Join(SYSROOT, e.program.interp)
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return LoaderError{path, fmt.Sprintf("interpreter %s: %v", e.program.interp, err)}
+	}
+	bin, err := elf.NewFile(bytes.NewReader(contents))
+	if err != nil {
+		return LoaderError{path, err.Error()}
+	}
+	if bin.Type != elf.ET_DYN {
+		return LoaderError{path, "interpreter is not a shared object"}
+	}
+
+	var segments []elf.ProgHeader
+	for _, hdr := range bin.Progs {
+		if hdr.Type == elf.PT_LOAD {
+			segments = append(segments, hdr.ProgHeader)
+		}
+	}
+
+	base := (uint64(e.curAlloc) + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	if err := e.validateElf(path, bin, contents, segments, base); err != nil {
+		return err
+	}
+	if err := e.mapSegments(contents, segments, base); err != nil {
+		return err
+	}
+	e.demoteSegments(segments, base)
+
+	// the interpreter's functions, libc's for musl, can be hooked too
+	for _, sym := range funcSymbols(bin) {
+		sym.Value += base
+		e.program.symbols = append(e.program.symbols, sym)
+	}
+	sort.Slice(e.program.symbols, func(i, j int) bool {
+		return e.program.symbols[i].Value < e.program.symbols[j].Value
+	})
+
+	e.program.interpBase = base
+	e.program.interpEntry = bin.Entry + base
+	e.programBrk = e.curAlloc
+	e.initialBrk = e.programBrk
+	e.setPC(e.program.interpEntry)
+	return nil
+}
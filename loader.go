@@ -0,0 +1,105 @@
+// elf validation - refuse binaries the emulator can't run before any of them
+// is loaded into memory.
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"sort"
+)
+
+// RISC-V specific e_flags
+const (
+	EF_RISCV_RVC              = 0x1
+	EF_RISCV_FLOAT_ABI        = 0x6
+	EF_RISCV_FLOAT_ABI_SOFT   = 0x0
+	EF_RISCV_FLOAT_ABI_SINGLE = 0x2
+	EF_RISCV_FLOAT_ABI_DOUBLE = 0x4
+	EF_RISCV_FLOAT_ABI_QUAD   = 0x6
+	EF_RISCV_RVE              = 0x8
+)
+
+// LoaderError is returned when a binary can't be loaded
+type LoaderError struct {
+	path   string
+	reason string
+}
+
+func (l LoaderError) Error() string {
+	return fmt.Sprintf("LoaderError{path: %s, reason: %s}", l.path, l.reason)
+}
+
+// validateElf checks that `bin` is an RV64I executable the emulator can run and
+// that its loadable `segments` are backed by `contents` and fit in memory when
+// loaded at `bias`.
+func (e *Emulator) validateElf(path string, bin *elf.File, contents []uint8,
+	segments []elf.ProgHeader, bias uint64) error {
+	fail := func(format string, args ...any) error {
+		return LoaderError{path, fmt.Sprintf(format, args...)}
+	}
+
+	if bin.Machine != elf.EM_RISCV {
+		return fail("machine is %s, not %s", bin.Machine, elf.EM_RISCV)
+	}
+	if bin.Class != elf.ELFCLASS64 {
+		return fail("class is %s, not %s", bin.Class, elf.ELFCLASS64)
+	}
+	if bin.Data != elf.ELFDATA2LSB {
+		return fail("data encoding is %s, not %s", bin.Data, elf.ELFDATA2LSB)
+	}
+	if bin.Type != elf.ET_EXEC && bin.Type != elf.ET_DYN {
+		return fail("type is %s, not an executable", bin.Type)
+	}
+
+	// e_flags is not exported by debug/elf, it follows e_entry, e_phoff and
+	// e_shoff in the 64-bit header
+	if len(contents) < 0x34 {
+		return fail("truncated elf header")
+	}
+	flags := bin.ByteOrder.Uint32(contents[0x30:])
+	if flags&EF_RISCV_RVC != 0 {
+		return fail("compressed instructions (RVC) are not supported")
+	}
+	if flags&EF_RISCV_RVE != 0 {
+		return fail("the RVE base ISA is not supported")
+	}
+	switch flags & EF_RISCV_FLOAT_ABI {
+	case EF_RISCV_FLOAT_ABI_SINGLE:
+		return fail("single-precision float ABI is not supported")
+	case EF_RISCV_FLOAT_ABI_DOUBLE:
+		return fail("double-precision float ABI is not supported")
+	case EF_RISCV_FLOAT_ABI_QUAD:
+		return fail("quad-precision float ABI is not supported")
+	}
+
+	if len(segments) == 0 {
+		return fail("no loadable segments")
+	}
+	for i, seg := range segments {
+		if seg.Filesz > seg.Memsz {
+			return fail("segment %d file size %#x is bigger than its memory size %#x",
+				i, seg.Filesz, seg.Memsz)
+		}
+		if seg.Off+seg.Filesz < seg.Off || seg.Off+seg.Filesz > uint64(len(contents)) {
+			return fail("segment %d at offset %#x with %#x bytes is outside the %#x byte file",
+				i, seg.Off, seg.Filesz, len(contents))
+		}
+		start := seg.Vaddr + bias
+		end := start + seg.Memsz
+		if start < seg.Vaddr || end < start || end > uint64(e.size) {
+			return fail("segment %d [%#x, %#x) does not fit in %#x bytes of memory",
+				i, start, end, e.size)
+		}
+	}
+
+	sorted := append([]elf.ProgHeader(nil), segments...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Vaddr < sorted[j].Vaddr })
+	for i := 1; i < len(sorted); i++ {
+		prev, seg := sorted[i-1], sorted[i]
+		if prev.Vaddr+prev.Memsz > seg.Vaddr {
+			return fail("segments [%#x, %#x) and [%#x, %#x) overlap",
+				prev.Vaddr, prev.Vaddr+prev.Memsz, seg.Vaddr, seg.Vaddr+seg.Memsz)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testBinaries returns the paths of the ELF binaries in testdata
+func testBinaries(t *testing.T) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.WalkDir("testdata", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		contents, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.HasPrefix(contents, []uint8(elf.ELFMAG)) {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no binaries in testdata")
+	}
+	return paths
+}
+
+// segmentPerms is the permission every page covered by `segments` should
+// have, the union of the segments on it
+func segmentPerms(segments []elf.ProgHeader, bias uint64) map[VirtAddr]Perm {
+	perms := make(map[VirtAddr]Perm)
+	for _, seg := range segments {
+		start, end := pageSpan(seg, bias)
+		for page := start; page < end; page += PAGE_SIZE {
+			perms[page] |= Perm(seg.Flags) & (PERM_READ | PERM_WRITE | PERM_EXEC)
+		}
+	}
+	return perms
+}
+
+// checkPagePerms fails unless every byte of the pages in `want` has exactly
+// the permission expected of its page
+func checkPagePerms(t *testing.T, m *Mmu, want map[VirtAddr]Perm) {
+	t.Helper()
+	perms := make([]Perm, PAGE_SIZE)
+	for page, perm := range want {
+		m.copyPerms(page, perms)
+		for i, p := range perms {
+			if p != perm {
+				t.Errorf("page %#x: byte %#x has %s, want %s", page, i, p, perm)
+				break
+			}
+		}
+	}
+}
+
+func TestMapSegments(t *testing.T) {
+	for _, path := range testBinaries(t) {
+		t.Run(path, func(t *testing.T) {
+			contents, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bin, err := elf.NewFile(bytes.NewReader(contents))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var segments []elf.ProgHeader
+			for _, prog := range bin.Progs {
+				if prog.Type == elf.PT_LOAD {
+					segments = append(segments, prog.ProgHeader)
+				}
+			}
+
+			e := NewEmulator(MEM_SIZE)
+			if err := e.mapSegments(contents, segments, 0); err != nil {
+				t.Fatal(err)
+			}
+			e.demoteSegments(segments, 0)
+
+			var end VirtAddr
+			for _, seg := range segments {
+				_, segEnd := pageSpan(seg, 0)
+				end = VirtAddr(max(uint(end), uint(segEnd)))
+
+				// the contents of the file are where the segment says
+				got := make([]uint8, seg.Filesz)
+				if err := e.copyBytes(VirtAddr(seg.Vaddr), got); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, contents[seg.Off:seg.Off+seg.Filesz]) {
+					t.Errorf("segment at %#x: contents differ from the file", seg.Vaddr)
+				}
+			}
+			if e.curAlloc != end {
+				t.Errorf("curAlloc is %#x, want %#x past the last segment", e.curAlloc, end)
+			}
+			checkPagePerms(t, e.Mmu, segmentPerms(segments, 0))
+		})
+	}
+}
+
+func TestMapProgram(t *testing.T) {
+	for _, path := range testBinaries(t) {
+		t.Run(path, func(t *testing.T) {
+			e := NewEmulator(MEM_SIZE)
+			if err := e.MapProgram(path, nil, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			// the stack and heap come after the segments and leave them alone
+			var end VirtAddr
+			for _, seg := range e.program.segments {
+				_, segEnd := pageSpan(seg, e.program.bias)
+				end = VirtAddr(max(uint(end), uint(segEnd)))
+			}
+			if e.initialBrk != end {
+				t.Errorf("initial break is %#x, want %#x", e.initialBrk, end)
+			}
+			if e.curAlloc < end {
+				t.Errorf("curAlloc %#x is below the end of the segments %#x", e.curAlloc, end)
+			}
+			checkPagePerms(t, e.Mmu, segmentPerms(e.program.segments, e.program.bias))
+		})
+	}
+}
+
+func TestMapSegmentsSharedPage(t *testing.T) {
+	// code and data sharing the page at 0x11000, like a linker packing
+	// segments without padding them to a page
+	contents := make([]uint8, 0x200)
+	segments := []elf.ProgHeader{
+		{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Off: 0, Vaddr: 0x10f00, Filesz: 0x180, Memsz: 0x180},
+		{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Off: 0x180, Vaddr: 0x11080, Filesz: 0x80, Memsz: 0x1000},
+	}
+	e := NewEmulator(MEM_SIZE)
+	if err := e.mapSegments(contents, segments, 0); err != nil {
+		t.Fatal(err)
+	}
+	e.demoteSegments(segments, 0)
+	if e.curAlloc != 0x13000 {
+		t.Errorf("curAlloc is %#x, want 0x13000", e.curAlloc)
+	}
+	checkPagePerms(t, e.Mmu, map[VirtAddr]Perm{
+		0x10000: PERM_READ | PERM_EXEC,
+		0x11000: PERM_READ | PERM_WRITE | PERM_EXEC,
+		0x12000: PERM_READ | PERM_WRITE,
+	})
+}
+
+func TestSetupTLS(t *testing.T) {
+	for _, tc := range []struct {
+		align uint64
+		ok    bool
+	}{
+		{0, true}, {1, true}, {0x40, true}, {0x18, false}, {0x30, false},
+	} {
+		e := NewEmulator(MEM_SIZE)
+		e.program.tls = elf.ProgHeader{Type: elf.PT_TLS, Align: tc.align, Memsz: 0x10}
+		err := e.setupTLS()
+		if !tc.ok {
+			if _, ok := err.(LoaderError); !ok {
+				t.Errorf("align %#x: setupTLS returned %v, want a LoaderError", tc.align, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("align %#x: %v", tc.align, err)
+		} else if tp := e.Reg(Tp); tc.align > 1 && tp%tc.align != 0 {
+			t.Errorf("align %#x: tp %#x is not aligned", tc.align, tp)
+		}
+	}
+}
@@ -3,12 +3,13 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-//go:generate stringer -type=Register,Perm,MemErrType -output=string.go
+//go:generate stringer -type=Register,Perm,MemErrType,HeapErrType -output=string.go
 
 var (
 	VERBOSE             bool
@@ -17,7 +18,32 @@ var (
 	VERBOSE_SYSCALL     bool
 	LOG_STATE           bool
 	DUMP_ELF_INFO       bool
+	ALLOW_UNINIT_READ   bool
+	SANITIZE_HEAP       bool
 	MEM_SIZE            uint // = 2 * 1024 * 1024
+	STACK_SIZE          uint
+	HEAP_SIZE           uint
+	ENV_VARS            stringsFlag
+	SYSROOT             string
+	WATCHPOINTS         watchFlags
+	SAVE_SNAPSHOT       string
+	SNAPSHOT_PC         uint64
+	SNAPSHOT_ICOUNT     uint64
+	LOAD_SNAPSHOT       string
+	MISALIGNED          AlignPolicy
+	ATTACH_UART         bool
+	UART_IN             string
+	UART_OUT            string
+	MEM_STATS           bool
+	MEM_STATS_JSON      string
+	IMAGE_FORMAT        ImageFormat
+	IMAGE_BASE          uint64
+	IMAGE_PERMS         = permFlag(PERM_READ | PERM_WRITE | PERM_EXEC)
+	IMAGE_ENTRY         uint64
+	CORE_FILE           string
+	SANDBOX             string
+	ROOTFS              string
+	STDIN               string
 )
 
 func init() {
@@ -27,7 +53,42 @@ func init() {
 	flag.BoolVar(&VERBOSE_SYSCALL, "verbose-syscall", false, "verbose output: system call information")
 	flag.BoolVar(&LOG_STATE, "dump-state", false, "dump state of emulator when the inferior program encounters error")
 	flag.BoolVar(&DUMP_ELF_INFO, "elf-info", false, "dump loaded elf binary info")
+	flag.BoolVar(&ALLOW_UNINIT_READ, "allow-uninit", false, "allow reads from allocated memory that was never written")
+	flag.BoolVar(&SANITIZE_HEAP, "sanitize", false, "replace malloc, free, calloc and realloc with a checked allocator")
+	flag.Var(&WATCHPOINTS, "watch", "stop when memory is accessed, addr:size:kind with kind r, w or rw (repeatable)")
+	flag.StringVar(&SAVE_SNAPSHOT, "save-snapshot", "", "save a snapshot of the program to this file at -snapshot-pc or -snapshot-icount")
+	flag.Uint64Var(&SNAPSHOT_PC, "snapshot-pc", 0, "take the snapshot before executing the instruction at this address")
+	flag.Uint64Var(&SNAPSHOT_ICOUNT, "snapshot-icount", 0, "take the snapshot after this many instructions")
+	flag.StringVar(&LOAD_SNAPSHOT, "load-snapshot", "", "resume execution from a snapshot file instead of loading a binary")
+	flag.Var(&MISALIGNED, "misaligned", "misaligned loads, stores and jump targets: allow, trap or count")
+	flag.BoolVar(&ATTACH_UART, "uart", false, "attach a 16550 UART at 0x10000000 connected to stdin and stdout instead of the program's standard input")
+	flag.StringVar(&UART_IN, "uart-in", "", "file the UART receives from instead of stdin")
+	flag.StringVar(&UART_OUT, "uart-out", "", "file the UART transmits to instead of stdout")
+	flag.BoolVar(&MEM_STATS, "mem-stats", false, "print memory usage statistics when the program exits")
+	flag.StringVar(&MEM_STATS_JSON, "mem-stats-json", "", "write memory usage statistics as JSON to this file when the program exits")
+	flag.Var(&ENV_VARS, "env", "add KEY=VAL to the program's environment (repeatable)")
+	flag.StringVar(&SYSROOT, "sysroot", "/", "directory the dynamic linker of dynamically linked programs is loaded from")
+	flag.Var(&IMAGE_FORMAT, "image", "format of the program file: elf, raw, ihex or srec")
+	flag.Uint64Var(&IMAGE_BASE, "image-base", 0, "address raw, ihex and srec images are loaded at")
+	flag.Var(&IMAGE_PERMS, "image-perms", "permissions of the loaded image, a combination of r, w and x")
+	flag.Uint64Var(&IMAGE_ENTRY, "entry", 0, "start address of raw, ihex and srec images (default image start address or base)")
+	flag.StringVar(&CORE_FILE, "core", "", "write an ELF core file to this path when the program crashes")
+	flag.StringVar(&SANDBOX, "sandbox", "", "host directory the program sees as its root filesystem (default an empty in-memory filesystem)")
+	flag.StringVar(&ROOTFS, "rootfs", "", "tar archive or directory loaded as the program's in-memory root filesystem")
+	flag.StringVar(&STDIN, "stdin", "", "file the program reads standard input from instead of the terminal")
 	flag.UintVar(&MEM_SIZE, "memsize", 1024*1024, "specify the memory size")
+	flag.UintVar(&STACK_SIZE, "stack-size", 0x1000, "specify the stack size")
+	flag.UintVar(&HEAP_SIZE, "heap-size", 0x1000, "specify the size of the initial heap")
+}
+
+// stringsFlag collects every value of a flag given more than once
+type stringsFlag []string
+
+func (s *stringsFlag) String() string { return strings.Join(*s, ",") }
+
+func (s *stringsFlag) Set(val string) error {
+	*s = append(*s, val)
+	return nil
 }
 
 func exitf(pattern string, args ...any) {
@@ -39,31 +100,80 @@ func exitf(pattern string, args ...any) {
 	os.Exit(1)
 }
 
+// fatalf reports why the program stopped and exits, there is nothing wrong
+// with the command line so the usage isn't printed
+func fatalf(pattern string, args ...any) {
+	if !strings.HasSuffix(pattern, "\n") {
+		pattern = pattern + "\n"
+	}
+	fmt.Fprintf(os.Stderr, pattern, args...)
+	os.Exit(1)
+}
+
 func main() {
 	flag.Parse()
 	args := flag.Args()
-	if len(args) < 1 {
+	if len(args) < 1 && LOAD_SNAPSHOT == "" {
 		exitf("%s [OPTIONS] <path/to/binary> [PROG ARGS]", os.Args[0])
 	}
 	var (
 		path string
 		err  error
+		emu  *Emulator
 	)
-	if path, err = filepath.Abs(args[0]); err != nil {
-		exitf("%v", err)
+	var fsys FS = NewMemFS()
+	if SANDBOX != "" && ROOTFS != "" {
+		exitf("-sandbox and -rootfs can't be used together")
 	}
-
-	emu := NewEmulator(MEM_SIZE)
-	if err := emu.MapProgram(path, args[1:]); err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	if SANDBOX != "" {
+		if fsys, err = NewHostFS(SANDBOX); err != nil {
+			exitf("%v", err)
+		}
+	}
+	if ROOTFS != "" {
+		if fsys, err = LoadRootFS(ROOTFS); err != nil {
+			exitf("%v", err)
+		}
+	}
+	if LOAD_SNAPSHOT != "" {
+		if emu, err = LoadSnapshot(LOAD_SNAPSHOT, fsys); err != nil {
+			exitf("%v", err)
+		}
+	} else {
+		if path, err = filepath.Abs(args[0]); err != nil {
+			exitf("%v", err)
+		}
+		emu = NewEmulator(MEM_SIZE)
+		emu.SetFS(fsys)
+		if IMAGE_FORMAT != IMAGE_ELF {
+			err = emu.MapImage(path, IMAGE_FORMAT, VirtAddr(IMAGE_BASE), Perm(IMAGE_PERMS), IMAGE_ENTRY)
+		} else {
+			err = emu.MapProgram(path, args[1:], ENV_VARS)
+		}
+		if err != nil {
+			exitf("%v", err)
+		}
+	}
+	if STDIN != "" {
+		if err := emu.StdinFile(STDIN); err != nil {
+			exitf("%v", err)
+		}
+	}
+	if ATTACH_UART {
+		if err := attachUART(emu); err != nil {
+			exitf("%v", err)
+		}
+	}
+	for _, w := range WATCHPOINTS {
+		emu.Watch(w.addr, w.size, w.kind)
 	}
 
 	if VERBOSE {
 		fmt.Println("")
 		fmt.Printf("PATH: %s\nFILENAME: %s\n", emu.program.path, emu.program.name)
 		fmt.Printf("MEM SIZE: %#x\n", MEM_SIZE-1)
-		fmt.Printf("STACK [%#x -> %#x]\n", emu.Stack(), emu.Stack()-STACK_SIZE)
-		fmt.Printf("HEAP [%#x -> %#x]\n", emu.Heap(), emu.Heap()+HEAP_SIZE)
+		fmt.Printf("STACK [%#x -> %#x]\n", emu.Stack(), emu.Stack()-VirtAddr(STACK_SIZE))
+		fmt.Printf("HEAP [%#x -> %#x]\n", emu.Heap(), emu.Heap()+VirtAddr(HEAP_SIZE))
 		fmt.Printf("CURRENT ALLOCATION: %#x\n", emu.Mmu.curAlloc)
 		fmt.Println("")
 	}
@@ -74,26 +184,96 @@ func main() {
 		}
 	}()
 
-	if err := emu.Run(); err != nil {
+	if MEM_STATS || MEM_STATS_JSON != "" {
+		emu.EnableStats()
+	}
+
+	if SAVE_SNAPSHOT != "" {
+		if SNAPSHOT_PC != 0 {
+			emu.BreakAt(SNAPSHOT_PC)
+		}
+		if SNAPSHOT_ICOUNT != 0 {
+			emu.BreakAfter(SNAPSHOT_ICOUNT)
+		}
+	}
+
+	err = emu.Run()
+	if e, ok := err.(EmuExit); ok && SAVE_SNAPSHOT != "" {
+		if _, ok := e.cause.(Breakpoint); ok {
+			if err := emu.SaveSnapshot(SAVE_SNAPSHOT); err != nil {
+				exitf("%v", err)
+			}
+			err = emu.Run()
+		}
+	}
+	if MISALIGNED == ALIGN_POLICY_COUNT {
+		fmt.Fprintln(os.Stderr, emu.MisalignedReport())
+	}
+	if MEM_STATS {
+		fmt.Fprintln(os.Stderr, emu.MemReport())
+	}
+	if MEM_STATS_JSON != "" {
+		if err := emu.MemReport().WriteJSON(MEM_STATS_JSON); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if err != nil {
 		handleErrors(emu, err)
 	}
 }
 
+// attachUART maps a UART connected to the host's stdio or to the files given
+// on the command line. Only one of the UART and the program's standard input
+// can read the host's stdin, the UART takes it unless -stdin is given.
+func attachUART(emu *Emulator) error {
+	var (
+		in  io.Reader = os.Stdin
+		out io.Writer = os.Stdout
+	)
+	if UART_IN != "" {
+		f, err := os.Open(UART_IN)
+		if err != nil {
+			return err
+		}
+		in = f
+	} else if STDIN == "" {
+		_ = emu.files.Close(0)
+	}
+	if UART_OUT != "" {
+		f, err := os.Create(UART_OUT)
+		if err != nil {
+			return err
+		}
+		out = f
+	}
+	return emu.MapDevice(UART_BASE, UART_SIZE, NewUART(in, out))
+}
+
 // handle emulator execution errors
 func handleErrors(emu *Emulator, err error) {
 	if e, ok := err.(EmuExit); ok {
+		if sig, crashed := coreSignal(e.cause); crashed && CORE_FILE != "" {
+			if err := emu.WriteCore(CORE_FILE, sig); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		}
 		switch t := e.cause.(type) {
 		case MMUError:
 			if LOG_STATE {
 				emu.Inspect(t.addr, t.size)
 				emu.InspectPerms(t.addr, t.size)
-				exitf("%s", e.Error())
+				fatalf("%s", e.Error())
+			}
+			if t.typ == ErrUninitRead {
+				fatalf("%s", e.Error())
 			}
 			return
+		case WatchpointHit, HeapError, AddrMisaligned, StackOverflow, IllegalInstruction, Ebreak:
+			fatalf("%s", e.Error())
 		case Done:
 			os.Exit(t.status)
 		}
 		return
 	}
-	exitf("%v", err)
+	fatalf("%v", err)
 }
@@ -0,0 +1,540 @@
+// memory filesystem - files that only exist in the emulator, programs can't
+// touch the host through it. The filesystem starts from an image, a tar
+// archive or a directory, and what the program changes is kept in an overlay
+// on top of it.
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MAX_SYMLINKS is the number of symbolic links followed looking up a path
+const MAX_SYMLINKS = 40
+
+// MAX_FILE_SIZE is the largest a file of a MemFS can grow, the program can't
+// use up the memory of the emulator by writing far past the end of one
+const MAX_FILE_SIZE = 1 << 30
+
+// memNode is a file, directory or symbolic link of a MemFS. The data of a
+// symbolic link is its target.
+type memNode struct {
+	data    []uint8
+	mode    fs.FileMode
+	modTime time.Time
+
+	// part of the image, the node is copied into the overlay to change it
+	lower bool
+}
+
+func (n *memNode) clone() *memNode {
+	return &memNode{
+		data:    append([]uint8(nil), n.data...),
+		mode:    n.mode,
+		modTime: n.modTime,
+	}
+}
+
+// MemFS is a filesystem held in memory
+type MemFS struct {
+	// the image the filesystem starts from, shared by forks and never changed
+	// once the program runs
+	lower map[string]*memNode
+
+	// changes made by the program, a nil node is a removed file
+	upper map[string]*memNode
+}
+
+// NewMemFS creates an empty memory filesystem
+func NewMemFS() *MemFS {
+	return &MemFS{
+		lower: map[string]*memNode{"/": {mode: fs.ModeDir | 0755, lower: true}},
+		upper: make(map[string]*memNode),
+	}
+}
+
+// WriteFile adds the file `name` to the image, creating its directories
+func (m *MemFS) WriteFile(name string, data []uint8, mode fs.FileMode) {
+	name = path.Clean("/" + name)
+	m.MkdirAll(path.Dir(name), 0755)
+	m.lower[name] = &memNode{data: data, mode: mode, modTime: time.Now(), lower: true}
+}
+
+// MkdirAll adds the directory `name` and any of its parents to the image
+func (m *MemFS) MkdirAll(name string, mode fs.FileMode) {
+	for name = path.Clean("/" + name); ; name = path.Dir(name) {
+		if _, ok := m.lower[name]; ok {
+			return
+		}
+		m.lower[name] = &memNode{mode: fs.ModeDir | mode.Perm(), modTime: time.Now(), lower: true}
+	}
+}
+
+// LoadRootFS creates a memory filesystem from the tar archive, optionally
+// gzip compressed, or the directory at `path` on the host
+func LoadRootFS(path string) (*MemFS, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return MemFSFromDir(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return MemFSFromTar(file)
+}
+
+// MemFSFromTar creates a memory filesystem with the contents of a tar archive
+func MemFSFromTar(r io.Reader) (*MemFS, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	} else {
+		r = br
+	}
+
+	m := NewMemFS()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return m, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := path.Clean("/" + hdr.Name)
+		mode := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			m.MkdirAll(name, mode)
+			m.lower[name].mode = fs.ModeDir | mode
+		case tar.TypeReg:
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			m.WriteFile(name, data, mode)
+		case tar.TypeSymlink:
+			m.WriteFile(name, []uint8(hdr.Linkname), fs.ModeSymlink|0777)
+		case tar.TypeLink:
+			if node, ok := m.lower[path.Clean("/"+hdr.Linkname)]; ok {
+				m.lower[name] = node
+			}
+		}
+	}
+}
+
+// MemFSFromDir creates a memory filesystem with a copy of a host directory
+func MemFSFromDir(dir string) (*MemFS, error) {
+	m := NewMemFS()
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		name := path.Clean("/" + filepath.ToSlash(rel))
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			m.MkdirAll(name, info.Mode())
+			m.lower[name].mode = fs.ModeDir | info.Mode().Perm()
+		case d.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			m.WriteFile(name, []uint8(target), fs.ModeSymlink|0777)
+		case d.Type().IsRegular():
+			data, err := os.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			m.WriteFile(name, data, info.Mode().Perm())
+		}
+		return nil
+	})
+	return m, err
+}
+
+// lookup finds the node at the clean path `name`
+func (m *MemFS) lookup(name string) (*memNode, bool) {
+	if node, ok := m.upper[name]; ok {
+		return node, node != nil
+	}
+	node, ok := m.lower[name]
+	return node, ok
+}
+
+// walk resolves `name` to a path without symbolic links in its directories,
+// or at all when `follow` is set. The file itself doesn't have to exist.
+func (m *MemFS) walk(name string, follow bool) (string, error) {
+	parts := strings.Split(path.Clean("/" + name)[1:], "/")
+	cur := "/"
+	for i, hops := 0, 0; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		last := i == len(parts)-1
+		next := path.Join(cur, parts[i])
+		node, ok := m.lookup(next)
+		switch {
+		case ok && node.mode&fs.ModeSymlink != 0 && (!last || follow):
+			if hops++; hops > MAX_SYMLINKS {
+				return "", ELOOP
+			}
+			target := path.Join(cur, string(node.data))
+			if path.IsAbs(string(node.data)) {
+				target = path.Clean(string(node.data))
+			}
+			parts = append(strings.Split(target[1:], "/"), parts[i+1:]...)
+			i, cur = -1, "/"
+			continue
+		case !ok && !last:
+			return "", ENOENT
+		case ok && !last && !node.mode.IsDir():
+			return "", ENOTDIR
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// copyUp moves the node at `name` into the overlay before it is changed
+func (m *MemFS) copyUp(name string, node *memNode) *memNode {
+	if !node.lower {
+		return node
+	}
+	c := node.clone()
+	if cur, ok := m.lookup(name); ok && cur == node {
+		m.upper[name] = c
+	}
+	return c
+}
+
+// children returns the names of the entries of the directory `dir`
+func (m *MemFS) children(dir string) []string {
+	seen := make(map[string]bool)
+	for _, layer := range []map[string]*memNode{m.upper, m.lower} {
+		for name := range layer {
+			if name != "/" && path.Dir(name) == dir && !seen[name] {
+				seen[name] = true
+			}
+		}
+	}
+	var names []string
+	for name := range seen {
+		if _, ok := m.lookup(name); ok {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// create makes a new node at the clean path `name` in the overlay
+func (m *MemFS) create(name string, mode fs.FileMode) (*memNode, error) {
+	if _, ok := m.lookup(name); ok {
+		return nil, EEXIST
+	}
+	parent, ok := m.lookup(path.Dir(name))
+	if !ok {
+		return nil, ENOENT
+	}
+	if !parent.mode.IsDir() {
+		return nil, ENOTDIR
+	}
+	node := &memNode{mode: mode, modTime: time.Now()}
+	m.upper[name] = node
+	return node, nil
+}
+
+func (m *MemFS) OpenFile(name string, flags int, mode fs.FileMode) (File, error) {
+	name, err := m.walk(name, flags&O_NOFOLLOW == 0)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := m.lookup(name)
+	switch {
+	case ok && flags&O_CREAT != 0 && flags&O_EXCL != 0:
+		return nil, EEXIST
+	case ok && node.mode&fs.ModeSymlink != 0:
+		return nil, ELOOP
+	case !ok && flags&O_CREAT == 0:
+		return nil, ENOENT
+	case !ok:
+		if node, err = m.create(name, mode.Perm()); err != nil {
+			return nil, err
+		}
+	}
+
+	if node.mode.IsDir() && flags&O_ACCMODE != O_RDONLY {
+		return nil, EISDIR
+	}
+	if !node.mode.IsDir() && flags&O_DIRECTORY != 0 {
+		return nil, ENOTDIR
+	}
+	if flags&O_TRUNC != 0 && flags&O_ACCMODE != O_RDONLY {
+		node = m.copyUp(name, node)
+		node.data = nil
+		node.modTime = time.Now()
+	}
+	return &memFile{m, name, node}, nil
+}
+
+func (m *MemFS) Stat(name string, follow bool) (fs.FileInfo, error) {
+	name, err := m.walk(name, follow)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := m.lookup(name)
+	if !ok {
+		return nil, ENOENT
+	}
+	return memInfo{path.Base(name), node}, nil
+}
+
+// Mkdir creates the directory `name` in the overlay
+func (m *MemFS) Mkdir(name string, mode fs.FileMode) error {
+	name, err := m.walk(name, false)
+	if err != nil {
+		return err
+	}
+	_, err = m.create(name, fs.ModeDir|mode.Perm())
+	return err
+}
+
+// Remove removes the file, or with `dir` the empty directory, `name`
+func (m *MemFS) Remove(name string, dir bool) error {
+	name, err := m.walk(name, false)
+	if err != nil {
+		return err
+	}
+	node, ok := m.lookup(name)
+	switch {
+	case !ok:
+		return ENOENT
+	case name == "/":
+		return EBUSY
+	case dir && !node.mode.IsDir():
+		return ENOTDIR
+	case !dir && node.mode.IsDir():
+		return EISDIR
+	case dir && len(m.children(name)) > 0:
+		return ENOTEMPTY
+	}
+	if _, ok := m.lower[name]; ok {
+		m.upper[name] = nil
+	} else {
+		delete(m.upper, name)
+	}
+	return nil
+}
+
+func (m *MemFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	name, err := m.walk(name, true)
+	if err != nil {
+		return nil, err
+	}
+	node, ok := m.lookup(name)
+	if !ok {
+		return nil, ENOENT
+	}
+	if !node.mode.IsDir() {
+		return nil, ENOTDIR
+	}
+	var entries []fs.DirEntry
+	for _, child := range m.children(name) {
+		node, _ := m.lookup(path.Join(name, child))
+		entries = append(entries, fs.FileInfoToDirEntry(memInfo{child, node}))
+	}
+	return entries, nil
+}
+
+// Rename moves the file or directory `from` to `to`, replacing what is there
+func (m *MemFS) Rename(from, to string) error {
+	from, err := m.walk(from, false)
+	if err != nil {
+		return err
+	}
+	if to, err = m.walk(to, false); err != nil {
+		return err
+	}
+	src, ok := m.lookup(from)
+	if !ok {
+		return ENOENT
+	}
+	if from == "/" || to == "/" {
+		return EBUSY
+	}
+	if strings.HasPrefix(to, from+"/") {
+		return EINVAL
+	}
+	if parent, ok := m.lookup(path.Dir(to)); !ok {
+		return ENOENT
+	} else if !parent.mode.IsDir() {
+		return ENOTDIR
+	}
+	if from == to {
+		return nil
+	}
+	if dst, ok := m.lookup(to); ok {
+		switch {
+		case src.mode.IsDir() && !dst.mode.IsDir():
+			return ENOTDIR
+		case !src.mode.IsDir() && dst.mode.IsDir():
+			return EISDIR
+		}
+		if err := m.Remove(to, dst.mode.IsDir()); err != nil {
+			return err
+		}
+	}
+
+	// a directory is moved with everything in it
+	moved := map[string]*memNode{from: src}
+	if src.mode.IsDir() {
+		for _, layer := range []map[string]*memNode{m.upper, m.lower} {
+			for name := range layer {
+				if strings.HasPrefix(name, from+"/") {
+					if node, ok := m.lookup(name); ok {
+						moved[name] = node
+					}
+				}
+			}
+		}
+	}
+	for name := range moved {
+		if _, ok := m.lower[name]; ok {
+			m.upper[name] = nil
+		} else {
+			delete(m.upper, name)
+		}
+	}
+	for name, node := range moved {
+		m.upper[to+strings.TrimPrefix(name, from)] = node
+	}
+	return nil
+}
+
+// Fork copies the filesystem, the image is shared and the overlay copied.
+// adopt moves a file open in the original filesystem to the copy.
+func (m *MemFS) Fork() (FS, func(File) (File, bool)) {
+	fork := &MemFS{lower: m.lower, upper: make(map[string]*memNode, len(m.upper))}
+	copies := make(map[*memNode]*memNode)
+	for name, node := range m.upper {
+		if node == nil {
+			fork.upper[name] = nil
+			continue
+		}
+		c, ok := copies[node]
+		if !ok {
+			c = node.clone()
+			copies[node] = c
+		}
+		fork.upper[name] = c
+	}
+	adopt := func(f File) (File, bool) {
+		mf, ok := f.(*memFile)
+		if !ok || mf.fs != m {
+			return nil, false
+		}
+		node := mf.node
+		if c, ok := copies[node]; ok {
+			node = c
+		} else if !node.lower {
+			// removed while open
+			node = node.clone()
+		}
+		return &memFile{fork, mf.name, node}, true
+	}
+	return fork, adopt
+}
+
+// memFile is an open file of a MemFS
+type memFile struct {
+	fs   *MemFS
+	name string
+	node *memNode
+}
+
+func (f *memFile) ReadAt(buf []uint8, off int64) (int, error) {
+	if f.node.mode.IsDir() {
+		return 0, EISDIR
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	return copy(buf, f.node.data[off:]), nil
+}
+
+func (f *memFile) WriteAt(buf []uint8, off int64) (int, error) {
+	if f.node.mode.IsDir() {
+		return 0, EISDIR
+	}
+	if off < 0 || off > MAX_FILE_SIZE-int64(len(buf)) {
+		return 0, EFBIG
+	}
+	f.node = f.fs.copyUp(f.name, f.node)
+	if end := off + int64(len(buf)); end > int64(len(f.node.data)) {
+		n := len(f.node.data)
+		if end > int64(cap(f.node.data)) {
+			size := 2 * end
+			if size > MAX_FILE_SIZE {
+				size = MAX_FILE_SIZE
+			}
+			grown := make([]uint8, end, size)
+			copy(grown, f.node.data)
+			f.node.data = grown
+		}
+		f.node.data = f.node.data[:end]
+
+		// the spare room may hold old contents, a hole up to `off` reads as
+		// zeroes
+		for i := range f.node.data[n:] {
+			f.node.data[n+i] = 0
+		}
+	}
+	f.node.modTime = time.Now()
+	return copy(f.node.data[off:], buf), nil
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return memInfo{path.Base(f.name), f.node}, nil }
+
+func (f *memFile) Close() error { return nil }
+
+// memInfo describes a file of a MemFS
+type memInfo struct {
+	name string
+	node *memNode
+}
+
+func (i memInfo) Name() string       { return i.name }
+func (i memInfo) Size() int64        { return int64(len(i.node.data)) }
+func (i memInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i memInfo) ModTime() time.Time { return i.node.modTime }
+func (i memInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i memInfo) Sys() any           { return nil }
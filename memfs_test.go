@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMemFSTruncateSparseWrite(t *testing.T) {
+	// a truncated file doesn't show its old contents through a hole
+	fsys := NewMemFS()
+	fsys.WriteFile("/file", []uint8("secret"), 0644)
+	file, err := fsys.OpenFile("/file", O_WRONLY|O_TRUNC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]uint8("x"), 4); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err = fsys.OpenFile("/file", O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]uint8, 8)
+	n, _ := file.ReadAt(buf, 0)
+	if got := string(buf[:n]); got != "\x00\x00\x00\x00x" {
+		t.Fatalf("file holds %q", got)
+	}
+}
+
+func TestMemFSSparseWrite(t *testing.T) {
+	fsys := NewMemFS()
+	file, err := fsys.OpenFile("/file", O_RDWR|O_CREAT, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []struct {
+		data string
+		off  int64
+	}{{"abcdefgh", 0}, {"12", 2}, {"z", 12}} {
+		if _, err := file.WriteAt([]uint8(w.data), w.off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	buf := make([]uint8, 16)
+	n, _ := file.ReadAt(buf, 0)
+	if got := string(buf[:n]); got != "ab12efgh\x00\x00\x00\x00z" {
+		t.Fatalf("file holds %q", got)
+	}
+}
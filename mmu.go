@@ -19,18 +19,24 @@ const (
 	PERM_READ  Perm = 0x4 // read permission
 	PERM_RAW   Perm = 0x8 // read-after-write permission
 
-	DIRTY_BLOCK_SIZE = 0x7f
+	PAGE_SIZE = 0x1000
 
-	STACK_SIZE = 0x1000
-	HEAP_SIZE  = 0x1000
+	// GUARD_SIZE is the size of the inaccessible region below the stack
+	GUARD_SIZE = PAGE_SIZE
+
+	// MAX_ALLOCS is the number of allocations remembered for error reports,
+	// the older half is forgotten when there are more
+	MAX_ALLOCS = 0x10000
 )
 
 // MemErrType represents the types of errors encountered during memory access
 type MemErrType int
 
 const (
-	ErrCopy  MemErrType = -1 // mem copy error
-	ErrPerms MemErrType = -2 // mem permission error
+	ErrCopy       MemErrType = -1 // mem copy error
+	ErrPerms      MemErrType = -2 // mem permission error
+	ErrUninitRead MemErrType = -3 // read of allocated but never written memory
+	ErrDevice     MemErrType = -4 // access a memory mapped device can't handle
 )
 
 // MMUError contains values that make it easier to trace memory access errors
@@ -39,9 +45,17 @@ type MMUError struct {
 	addr VirtAddr
 	size uint
 	perm Perm
+
+	// site describes where the memory being accessed was allocated, it is
+	// only known for uninitialized reads.
+	site string
 }
 
 func (m MMUError) Error() string {
+	if m.site != "" {
+		return fmt.Sprintf("MMUError{typ: %s, addr: %#v, size: %d, perm: %s, alloc: %s}",
+			m.typ, m.addr, m.size, m.perm, m.site)
+	}
 	return fmt.Sprintf("MMUError{typ: %s, addr: %#v, size: %d, perm: %s}",
 		m.typ, m.addr, m.size, m.perm)
 }
@@ -49,20 +63,39 @@ func (m MMUError) Error() string {
 // VirtAddr is any point in the program's address space
 type VirtAddr uint
 
-// Block is a block of memory, it maps the start of an allocated block to its
-// end
-type Block = map[VirtAddr]VirtAddr
+// page is a PAGE_SIZE block of memory and the permissions on it. Pages are
+// shared between forked Mmus until one of them writes to it.
+type page struct {
+	data  [PAGE_SIZE]uint8
+	perms [PAGE_SIZE]Perm
+}
+
+// zeroPage backs all memory that has never been written, it is never owned
+// so it is never modified.
+var zeroPage = &page{}
+
+// Allocation records a region of memory handed out to the program and where
+// it was handed out from, so bad accesses can be traced back to their origin.
+type Allocation struct {
+	base VirtAddr
+	size uint
+	site string
+}
 
 // Mmu is an isolated memory space
 type Mmu struct {
-	// memory is blob of memory space available to the emulator
-	memory []uint8
+	// memory and access restrictions on it, in pages
+	pages []*page
 
-	// access restrictions on individual locations in memory
-	permissions []Perm
+	// pages that belong to this Mmu alone and can be modified in place, the
+	// rest are shared and copied before the first write
+	owned []bool
 
-	// map of modified blocks of memory
-	dirty Block
+	// pages copied since the Mmu was forked or reset
+	dirty []int
+
+	// size of the memory in bytes
+	size uint
 
 	// tracks the current allocation
 	curAlloc VirtAddr
@@ -73,12 +106,29 @@ type Mmu struct {
 	// the start of the heap memory
 	heap VirtAddr
 
+	// the start of the guard region below the stack, allocations stop there
+	guard      VirtAddr
+	allocLimit VirtAddr
+
 	// keep track of the program start in memory
 	programStart VirtAddr
+
+	// regions allocated to the program (stack, heap, brk, mmap)
+	allocs []Allocation
+
+	// regions of memory being watched and the last watchpoint hit
+	watchpoints []Watchpoint
+	hit         *WatchpointHit
+
+	// memory mapped devices
+	devices []devMapping
+
+	// access statistics, only gathered when enabled
+	stats *MemStats
 }
 
 // get the size of the memory
-func (m Mmu) Len() int { return len(m.memory) }
+func (m Mmu) Len() int { return int(m.size) }
 
 func (m *Mmu) setHeap(addr VirtAddr) { m.heap = addr }
 
@@ -88,39 +138,82 @@ func (m Mmu) Heap() VirtAddr { return m.heap }
 
 func (m Mmu) Stack() VirtAddr { return m.stack }
 
+// setGuard makes the GUARD_SIZE bytes from `addr` inaccessible and stops
+// allocations from reaching into them.
+func (m *Mmu) setGuard(addr VirtAddr) {
+	m.SetPermissions(addr, GUARD_SIZE, 0)
+	m.guard = addr
+	m.allocLimit = addr
+}
+
+// InGuard reports whether an access of `size` bytes at `addr` touches the
+// guard region below the stack
+func (m Mmu) InGuard(addr VirtAddr, size uint) bool {
+	if m.guard == 0 {
+		return false
+	}
+	return addr < m.guard+GUARD_SIZE && m.guard < addr+VirtAddr(max(size, 1))
+}
+
 func NewMmu(size uint) *Mmu {
+	npages := (size + PAGE_SIZE - 1) / PAGE_SIZE
+	pages := make([]*page, npages)
+	for i := range pages {
+		pages[i] = zeroPage
+	}
 	return &Mmu{
-		memory:       make([]uint8, size),
-		permissions:  make([]Perm, size),
-		dirty:        make(Block),
+		pages:        pages,
+		owned:        make([]bool, npages),
+		size:         size,
+		allocLimit:   VirtAddr(size),
 		curAlloc:     VirtAddr(0x100),
 		programStart: 0,
 	}
 }
 
-// Reset restores all memory back to the original state.
+// Reset restores all memory back to the original state. `other` must be the
+// Mmu this one was forked from.
 func (m *Mmu) Reset(other *Mmu) {
-	for addr, endAddr := range m.dirty {
-		start := int(addr)
-		end := int(endAddr)
-
-		// restore memory state
-		copy(m.memory[start:end], other.memory[start:end])
-		// restore permissions
-		copy(m.permissions[start:end], other.permissions[start:end])
+	// share the pages of the original again, the original gives up
+	// ownership of them like it does on Fork
+	for _, i := range m.dirty {
+		m.pages[i] = other.pages[i]
+		m.owned[i] = false
+		other.owned[i] = false
 	}
 	// clear dirty list
-	m.dirty = make(Block)
+	m.dirty = m.dirty[:0]
+
+	m.curAlloc = other.curAlloc
+	m.stack = other.stack
+	m.heap = other.heap
+	m.guard = other.guard
+	m.allocLimit = other.allocLimit
+	m.programStart = other.programStart
+	m.allocs = append(m.allocs[:0], other.allocs...)
+	m.hit = nil
 }
 
-// Fork an existing Mmu
+// Fork an existing Mmu. The fork shares all memory with the original, a page
+// is only copied when either of them writes to it.
 func (m *Mmu) Fork() *Mmu {
+	// the original gives up ownership so its writes don't leak into the fork
+	for i := range m.owned {
+		m.owned[i] = false
+	}
 	mmu := &Mmu{
-		memory:       append(make([]uint8, 0, len(m.memory)), m.memory...),
-		permissions:  append(make([]Perm, 0, len(m.permissions)), m.permissions...),
-		dirty:        make(Block),
+		pages:        append([]*page(nil), m.pages...),
+		owned:        make([]bool, len(m.pages)),
+		size:         m.size,
 		curAlloc:     m.curAlloc,
+		stack:        m.stack,
+		heap:         m.heap,
+		guard:        m.guard,
+		allocLimit:   m.allocLimit,
 		programStart: m.programStart,
+		allocs:       append([]Allocation(nil), m.allocs...),
+		watchpoints:  append([]Watchpoint(nil), m.watchpoints...),
+		devices:      m.devices,
 	}
 	return mmu
 }
@@ -132,112 +225,267 @@ func (m *Mmu) Allocate(size uint) VirtAddr {
 
 // Allocate memory with specified permissions
 func (m *Mmu) AllocatePerms(size uint, perm Perm) VirtAddr {
-	// 16-byte align the allocation
-	alignSize := (size + 0xf) &^ 0xf
-
 	base := m.curAlloc
-	if int(base) >= len(m.memory) {
+	if base >= m.allocLimit {
 		return 0
 	}
-	m.curAlloc += VirtAddr(alignSize)
 
-	// could not satisfy allocation without going out of memory
-	if int(m.curAlloc) > len(m.memory) {
-		m.curAlloc = base
+	// could not satisfy allocation without going out of memory, the size is
+	// checked before aligning it so it can't wrap around
+	left := uint(m.allocLimit - base)
+	if size > left {
+		return 0
+	}
+
+	// 16-byte align the allocation
+	alignSize := (size + 0xf) &^ 0xf
+	if alignSize > left {
 		return 0
 	}
+	m.curAlloc += VirtAddr(alignSize)
 	m.SetPermissions(base, size, perm)
 	return base
 }
 
+// TrackAllocation remembers that `size` bytes from `base` were allocated at
+// `site`. Later allocations covering the same address take precedence.
+func (m *Mmu) TrackAllocation(base VirtAddr, size uint, site string) {
+	if len(m.allocs) == MAX_ALLOCS {
+		m.allocs = append(m.allocs[:0], m.allocs[MAX_ALLOCS/2:]...)
+	}
+	m.allocs = append(m.allocs, Allocation{base, size, site})
+}
+
+// AllocationAt returns the most recent allocation containing `addr`
+func (m Mmu) AllocationAt(addr VirtAddr) (Allocation, bool) {
+	for i := len(m.allocs) - 1; i >= 0; i-- {
+		a := m.allocs[i]
+		if addr >= a.base && uint(addr) < uint(a.base)+a.size {
+			return a, true
+		}
+	}
+	return Allocation{}, false
+}
+
+// writable reports whether the program can write all of the `size` bytes
+// from `addr`, without writing anything
+func (m *Mmu) writable(addr VirtAddr, size uint) bool {
+	if !m.inBounds(addr, size) {
+		return false
+	}
+	for pos := uint(0); pos < size; {
+		idx, off, n := span(addr+VirtAddr(pos), size-pos)
+		for _, p := range m.pages[idx].perms[off : off+n] {
+			if p&PERM_WRITE == 0 {
+				return false
+			}
+		}
+		pos += uint(n)
+	}
+	return true
+}
+
+// inBounds reports whether `size` bytes from `addr` are all in memory
+func (m *Mmu) inBounds(addr VirtAddr, size uint) bool {
+	end := uint(addr) + size
+	return end >= uint(addr) && end <= m.size
+}
+
+// span returns the page index, the offset into the page and the number of
+// bytes that fit in the page for an access of `size` bytes at `addr`
+func span(addr VirtAddr, size uint) (idx int, off int, n int) {
+	idx, off = int(uint(addr)/PAGE_SIZE), int(uint(addr)%PAGE_SIZE)
+	n = PAGE_SIZE - off
+	if uint(n) > size {
+		n = int(size)
+	}
+	return
+}
+
+// writablePage returns the page at `idx`, copying it first if it is shared
+func (m *Mmu) writablePage(idx int) *page {
+	if !m.owned[idx] {
+		p := *m.pages[idx]
+		m.pages[idx] = &p
+		m.owned[idx] = true
+		m.dirty = append(m.dirty, idx)
+	}
+	return m.pages[idx]
+}
+
 // SetPermission sets the required permissions on memory locations starting
 // from the	`addr` to `addr+size`
 func (m *Mmu) SetPermissions(addr VirtAddr, size uint, perm Perm) {
-	for i := uint(addr); i < uint(addr)+size; i++ {
-		m.permissions[i] = perm
+	if uint(addr) >= m.size {
+		return
+	}
+	if !m.inBounds(addr, size) {
+		size = m.size - uint(addr)
+	}
+	for size > 0 {
+		idx, off, n := span(addr, size)
+		perms := m.writablePage(idx).perms[off : off+n]
+		for i := range perms {
+			perms[i] = perm
+		}
+		addr += VirtAddr(n)
+		size -= uint(n)
 	}
 }
 
 // WriteFrom copies the buffer `buf` into memory checking the necessary
 // permission before doing so
 func (m *Mmu) WriteFrom(addr VirtAddr, buf []uint8) error {
-	perms := m.permissions[int(addr) : len(buf)+int(addr)]
+	if len(m.devices) > 0 {
+		if d, ok := m.device(addr, uint(len(buf))); ok {
+			return d.write(addr, buf)
+		}
+	}
+	if !m.inBounds(addr, uint(len(buf))) {
+		return MMUError{typ: ErrPerms, addr: addr, size: uint(len(buf))}
+	}
 
 	hasRAW := false
-	for _, p := range perms {
-		// check if any part of the memory has read-after-write
-		hasRAW = hasRAW || ((p & PERM_RAW) != 0)
-
-		// check if all perms are set to write
-		if (p & PERM_WRITE) == 0 {
-			return MMUError{typ: ErrPerms, addr: addr, size: uint(len(buf))}
+	for pos := 0; pos < len(buf); {
+		idx, off, n := span(addr+VirtAddr(pos), uint(len(buf)-pos))
+		for _, p := range m.pages[idx].perms[off : off+n] {
+			// check if any part of the memory has read-after-write
+			hasRAW = hasRAW || ((p & PERM_RAW) != 0)
+
+			// check if all perms are set to write
+			if (p & PERM_WRITE) == 0 {
+				return MMUError{typ: ErrPerms, addr: addr, size: uint(len(buf))}
+			}
 		}
+		pos += n
 	}
 
-	// copy the slice `buf` into memory pointed to by `addr`
-	n := copy(m.memory[int(addr):len(buf)+int(addr)], buf)
+	var old []uint8
+	w, watched := m.watched(addr, uint(len(buf)), WATCH_WRITE)
+	if watched {
+		old = make([]uint8, len(buf))
+		_ = m.copyBytes(addr, old)
+	}
 
-	// update permissions and allow reading after writing
-	if hasRAW {
-		for i, p := range perms {
-			if (p & PERM_RAW) != 0 {
-				perms[i] |= PERM_READ
+	// copy the slice `buf` into memory pointed to by `addr`, making private
+	// copies of shared pages
+	for pos := 0; pos < len(buf); {
+		idx, off, n := span(addr+VirtAddr(pos), uint(len(buf)-pos))
+		p := m.writablePage(idx)
+		copy(p.data[off:off+n], buf[pos:pos+n])
+
+		// update permissions and allow reading after writing
+		if hasRAW {
+			for i, perm := range p.perms[off : off+n] {
+				if (perm & PERM_RAW) != 0 {
+					p.perms[off+i] |= PERM_READ
+				}
 			}
 		}
+		pos += n
 	}
 
-	// update the dirty block map
-	// aligned block to keep track of modified memory
-	blockStart := (int(addr) + DIRTY_BLOCK_SIZE) &^ DIRTY_BLOCK_SIZE
-	round := DIRTY_BLOCK_SIZE + 1
-	if blockStart > int(addr) {
-		blockStart -= round
+	if watched && m.hit == nil {
+		m.hit = &WatchpointHit{watch: w, access: WATCH_WRITE, addr: addr,
+			old: old, new: append([]uint8(nil), buf...)}
+	}
+	if m.stats != nil {
+		m.stats.record(addr, uint(len(buf)), true, m.curAlloc)
 	}
-	// align block to the dirty block size
-	numBlocks := int((n+DIRTY_BLOCK_SIZE)&^DIRTY_BLOCK_SIZE) / round
-	// end index of the aligned block
-	blockEnd := VirtAddr(blockStart + (numBlocks * round) - 1)
-	// add block `start - end` to dirty blocks map
-	m.dirty[VirtAddr(blockStart)] = blockEnd
 	return nil
 }
 
-func (m Mmu) copyBytes(addr VirtAddr, buf []uint8) error {
-	// copy from the address pointed to by `addr` to len(buf) into `buf`
-	if copy(buf, m.memory[int(addr):len(buf)+int(addr)]) != len(buf) {
+func (m *Mmu) copyBytes(addr VirtAddr, buf []uint8) error {
+	if !m.inBounds(addr, uint(len(buf))) {
 		return MMUError{typ: ErrCopy, addr: addr, size: uint(len(buf))}
 	}
+	// copy from the address pointed to by `addr` to len(buf) into `buf`
+	for pos := 0; pos < len(buf); {
+		idx, off, n := span(addr+VirtAddr(pos), uint(len(buf)-pos))
+		copy(buf[pos:pos+n], m.pages[idx].data[off:off+n])
+		pos += n
+	}
 	return nil
 }
 
+// copyPerms copies the permissions on `len(buf)` bytes from `addr` into buf
+func (m *Mmu) copyPerms(addr VirtAddr, buf []Perm) {
+	for pos := 0; pos < len(buf) && m.inBounds(addr+VirtAddr(pos), 1); {
+		idx, off, n := span(addr+VirtAddr(pos), uint(len(buf)-pos))
+		copy(buf[pos:pos+n], m.pages[idx].perms[off:off+n])
+		pos += n
+	}
+}
+
 // ReadIntoPerms reads data of `len(buf)` from memory into buf only if the region
 // of memory been read has `perm` set on it
-func (m Mmu) ReadIntoPerms(addr VirtAddr, buf []uint8, perm Perm) error {
+func (m *Mmu) ReadIntoPerms(addr VirtAddr, buf []uint8, perm Perm) error {
+	if len(m.devices) > 0 {
+		if d, ok := m.device(addr, uint(len(buf))); ok {
+			// devices can't hold code
+			if perm&PERM_EXEC != 0 {
+				return MMUError{typ: ErrDevice, addr: addr, size: uint(len(buf)), perm: perm}
+			}
+			return d.read(addr, buf)
+		}
+	}
+	if !m.inBounds(addr, uint(len(buf))) {
+		return MMUError{typ: ErrPerms, addr: addr, size: uint(len(buf)), perm: perm}
+	}
+
 	//get the permission on the region of memory to read from
-	perms := m.permissions[int(addr) : len(buf)+int(addr)]
+	for pos := 0; pos < len(buf); {
+		idx, off, n := span(addr+VirtAddr(pos), uint(len(buf)-pos))
+		for i, p := range m.pages[idx].perms[off : off+n] {
+			// check if all perms on region of memory is expected perm
+			// if (p & perm) == 0 {
+			if (p & perm) != perm {
+				// memory that is read-after-write but has not been written yet
+				if perm&PERM_READ != 0 && p&PERM_RAW != 0 {
+					bad := addr + VirtAddr(pos+i)
+					err := MMUError{typ: ErrUninitRead, addr: bad, size: uint(len(buf)), perm: perm}
+					if a, ok := m.AllocationAt(bad); ok {
+						err.site = a.site
+					}
+					return err
+				}
+				return MMUError{typ: ErrPerms, addr: addr, size: uint(len(buf)), perm: perm}
+			}
+		}
+		pos += n
+	}
+	if err := m.copyBytes(addr, buf); err != nil {
+		return err
+	}
+	if m.stats != nil && perm&PERM_READ != 0 {
+		m.stats.record(addr, uint(len(buf)), false, m.curAlloc)
+	}
 
-	for _, p := range perms {
-		// check if all perms on region of memory is expected perm
-		// if (p & perm) == 0 {
-		if (p & perm) != perm {
-			return MMUError{typ: ErrPerms, addr: addr, size: uint(len(buf)), perm: perm}
+	if perm&PERM_READ != 0 && m.hit == nil {
+		if w, ok := m.watched(addr, uint(len(buf)), WATCH_READ); ok {
+			val := append([]uint8(nil), buf...)
+			m.hit = &WatchpointHit{watch: w, access: WATCH_READ, addr: addr, old: val, new: val}
 		}
 	}
-	return m.copyBytes(addr, buf)
+	return nil
 }
 
-func (m Mmu) Inspect(addr VirtAddr, size uint) {
+func (m *Mmu) Inspect(addr VirtAddr, size uint) {
 	alignSize := (size + 0xf) &^ 0xf
-	spew.Dump(m.memory[addr : uint(addr)+alignSize])
+	buf := make([]uint8, alignSize)
+	_ = m.copyBytes(addr, buf)
+	spew.Dump(buf)
 }
 
-func (m Mmu) InspectPerms(addr VirtAddr, size uint) {
+func (m *Mmu) InspectPerms(addr VirtAddr, size uint) {
 	alignSize := (size + 0xf) &^ 0xf
-	spew.Dump(m.permissions[addr : uint(addr)+alignSize])
+	perms := make([]Perm, alignSize)
+	m.copyPerms(addr, perms)
+	spew.Dump(perms)
 }
 
 // ReadInto reads data of `len(buf)` from readable memory starting at addr into buf
-func (m Mmu) ReadInto(addr VirtAddr, buf []uint8) error {
+func (m *Mmu) ReadInto(addr VirtAddr, buf []uint8) error {
 	return m.ReadIntoPerms(addr, buf, PERM_READ)
 }
 
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+// readString reads `n` bytes at `addr` of `m`
+func readString(t *testing.T, m *Mmu, addr VirtAddr, n int) string {
+	t.Helper()
+	buf := make([]uint8, n)
+	if err := m.ReadInto(addr, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestForkCopyOnWrite(t *testing.T) {
+	parent := NewMmu(4 * PAGE_SIZE)
+	addr := parent.Allocate(PAGE_SIZE)
+	if err := parent.WriteFrom(addr, []uint8("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	child := parent.Fork()
+	if err := child.WriteFrom(addr, []uint8("child!")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, parent, addr, 6); got != "before" {
+		t.Fatalf("parent reads %q after the child wrote", got)
+	}
+	if err := parent.WriteFrom(addr, []uint8("parent")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, child, addr, 6); got != "child!" {
+		t.Fatalf("child reads %q after the parent wrote", got)
+	}
+	if got := readString(t, parent, addr, 6); got != "parent" {
+		t.Fatalf("parent reads %q", got)
+	}
+}
+
+func TestForkParentWriteFirst(t *testing.T) {
+	// the parent owned the page before forking, its write must not go into
+	// the page the child still shares
+	parent := NewMmu(4 * PAGE_SIZE)
+	addr := parent.Allocate(PAGE_SIZE)
+	if err := parent.WriteFrom(addr, []uint8("before")); err != nil {
+		t.Fatal(err)
+	}
+	child := parent.Fork()
+	if err := parent.WriteFrom(addr, []uint8("parent")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, child, addr, 6); got != "before" {
+		t.Fatalf("child reads %q after the parent wrote", got)
+	}
+}
+
+func TestReset(t *testing.T) {
+	parent := NewMmu(4 * PAGE_SIZE)
+	addr := parent.Allocate(PAGE_SIZE)
+	if err := parent.WriteFrom(addr, []uint8("before")); err != nil {
+		t.Fatal(err)
+	}
+	child := parent.Fork()
+	if err := child.WriteFrom(addr, []uint8("child!")); err != nil {
+		t.Fatal(err)
+	}
+	if len(child.dirty) == 0 {
+		t.Fatal("write didn't mark the page dirty")
+	}
+
+	child.Reset(parent)
+	if got := readString(t, child, addr, 6); got != "before" {
+		t.Fatalf("child reads %q after the reset", got)
+	}
+	if len(child.dirty) != 0 {
+		t.Fatalf("%d dirty pages after the reset", len(child.dirty))
+	}
+	idx := int(addr / PAGE_SIZE)
+	if child.owned[idx] || parent.owned[idx] {
+		t.Fatal("restored page is owned after the reset")
+	}
+
+	// the page is shared again, writes on either side are copied
+	if err := child.WriteFrom(addr, []uint8("again!")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, parent, addr, 6); got != "before" {
+		t.Fatalf("parent reads %q after the reset child wrote", got)
+	}
+
+	// a page the parent wrote since the fork is shared by the reset, the
+	// parent gives up owning it
+	if err := parent.WriteFrom(addr, []uint8("parent")); err != nil {
+		t.Fatal(err)
+	}
+	child.Reset(parent)
+	if got := readString(t, child, addr, 6); got != "parent" {
+		t.Fatalf("child reads %q after the reset", got)
+	}
+	if err := parent.WriteFrom(addr, []uint8("PARENT")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, child, addr, 6); got != "parent" {
+		t.Fatalf("reset child reads %q after the parent wrote", got)
+	}
+}
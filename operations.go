@@ -183,6 +183,9 @@ func (e *Emulator) decodeItype32bitArith(ins uint32) {
 func (e *Emulator) decodeItypeLoads(ins uint32) error {
 	inst := Decode(ins, Itype{}).(Itype)
 	addr := VirtAddr(e.Reg(inst.rs1) + uint64(int64(inst.imm)))
+	if err := e.checkAlign(addr, 1<<(inst.funct3&0b11), ALIGN_LOAD); err != nil {
+		return err
+	}
 
 	switch inst.funct3 {
 	case 0x0:
@@ -244,6 +247,9 @@ func (e *Emulator) decodeStypeStore(ins uint32) (err error) {
 	inst := Decode(ins, Stype{}).(Stype)
 	addr := VirtAddr(e.Reg(inst.rs1) + uint64(int64(inst.imm)))
 	val := e.Reg(inst.rs2)
+	if err := e.checkAlign(addr, 1<<(inst.funct3&0b11), ALIGN_STORE); err != nil {
+		return err
+	}
 
 	switch inst.funct3 {
 	case 0x0:
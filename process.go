@@ -0,0 +1,173 @@
+// process setup - the initial stack the linux kernel hands to a new program
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// auxiliary vector entry types
+const (
+	AT_NULL   = 0
+	AT_PHDR   = 3
+	AT_PHENT  = 4
+	AT_PHNUM  = 5
+	AT_PAGESZ = 6
+	AT_BASE   = 7
+	AT_ENTRY  = 9
+	AT_UID    = 11
+	AT_EUID   = 12
+	AT_GID    = 13
+	AT_EGID   = 14
+	AT_HWCAP  = 16
+	AT_SECURE = 23
+	AT_RANDOM = 25
+)
+
+// HWCAP_RV64I is the hardware capability of the emulated machine, one bit per
+// supported single letter extension.
+const HWCAP_RV64I = 1 << ('I' - 'A')
+
+// AT_RANDOM_BYTES are the "random" bytes libc seeds stack protectors and
+// pointer guards with, they are fixed so runs are reproducible.
+var AT_RANDOM_BYTES = [16]uint8{
+	0x73, 0x69, 0x6d, 0x70, 0x6d, 0x75, 0x6c, 0x61,
+	0x74, 0x6f, 0x72, 0x72, 0x61, 0x6e, 0x64, 0x21,
+}
+
+// programHeaders finds where the program headers are mapped in memory and
+// how many there are.
+func programHeaders(bin *elf.File, contents []uint8) (phdr, phnum uint64) {
+	phnum = uint64(len(bin.Progs))
+	for _, p := range bin.Progs {
+		if p.Type == elf.PT_PHDR {
+			return p.Vaddr, phnum
+		}
+	}
+
+	// no PT_PHDR, look for the loadable segment that holds the headers
+	if bin.Class != elf.ELFCLASS64 || len(contents) < 0x28 {
+		return 0, phnum
+	}
+	phoff := binary.LittleEndian.Uint64(contents[0x20:0x28])
+	for _, p := range bin.Progs {
+		if p.Type == elf.PT_LOAD && phoff >= p.Off && phoff < p.Off+p.Filesz {
+			return p.Vaddr + phoff - p.Off, phnum
+		}
+	}
+	return 0, phnum
+}
+
+// setupStack lays out the stack the way the kernel does for a new process
+//
+//	+---------------------------+ <- initial SP from allocStackAndHeap
+//	| argv and envp strings     |
+//	| AT_RANDOM bytes           |
+//	| (16-byte alignment)       |
+//	+---------------------------+
+//	| auxv pairs, AT_NULL last  |
+//	| envp pointers, NULL       |
+//	| argv pointers, NULL       |
+//	| argc                      |
+//	+---------------------------+ <- SP at program entry
+func (e *Emulator) setupStack(argv, envp []string) error {
+	sp := e.Reg(Sp)
+
+	// copy a string to the top of the stack and return its address
+	pushString := func(str string) (uint64, error) {
+		sp -= uint64(len(str) + 1)
+		return sp, e.WriteFrom(VirtAddr(sp), append([]uint8(str), 0))
+	}
+
+	argPtrs := make([]uint64, len(argv))
+	for i, arg := range argv {
+		addr, err := pushString(arg)
+		if err != nil {
+			return err
+		}
+		argPtrs[i] = addr
+	}
+	envPtrs := make([]uint64, len(envp))
+	for i, env := range envp {
+		addr, err := pushString(env)
+		if err != nil {
+			return err
+		}
+		envPtrs[i] = addr
+	}
+
+	sp -= uint64(len(AT_RANDOM_BYTES))
+	random := sp
+	if err := e.WriteFrom(VirtAddr(random), AT_RANDOM_BYTES[:]); err != nil {
+		return err
+	}
+
+	auxv := []uint64{
+		AT_PHDR, e.program.phdr,
+		AT_PHENT, 56, // size of an elf64 program header
+		AT_PHNUM, e.program.phnum,
+		AT_PAGESZ, PAGE_SIZE,
+		AT_BASE, e.program.interpBase,
+		AT_ENTRY, e.program.entry,
+		AT_UID, 0,
+		AT_EUID, 0,
+		AT_GID, 0,
+		AT_EGID, 0,
+		AT_SECURE, 0,
+		AT_HWCAP, HWCAP_RV64I,
+		AT_RANDOM, random,
+		AT_NULL, 0,
+	}
+
+	words := []uint64{uint64(len(argv))}
+	words = append(words, argPtrs...)
+	words = append(words, 0)
+	words = append(words, envPtrs...)
+	words = append(words, 0)
+	words = append(words, auxv...)
+
+	// the stack pointer must be 16-byte aligned once everything is pushed
+	sp = (sp - uint64(len(words))*8) &^ 0xf
+	e.SetReg(Sp, sp+uint64(len(words))*8)
+	for i := len(words) - 1; i >= 0; i-- {
+		if err := push(e, words[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupTLS creates the thread-local storage block of the main thread from the
+// PT_TLS template and points tp at it. RISC-V uses TLS variant I, tp points at
+// the start of the block with the .tdata image followed by the zeroed .tbss.
+func (e *Emulator) setupTLS() error {
+	tls := e.program.tls
+	if tls.Align&(tls.Align-1) != 0 {
+		return LoaderError{e.program.path, fmt.Sprintf("TLS alignment %#x is not a power of two", tls.Align)}
+	}
+	if tls.Filesz > tls.Memsz {
+		return LoaderError{e.program.path, fmt.Sprintf("TLS template of %#x bytes bigger than its segment", tls.Filesz)}
+	}
+	align := tls.Align
+	if align < 0x10 {
+		align = 0x10
+	}
+
+	block := e.Allocate(uint(tls.Memsz + align))
+	if block == 0 {
+		return fmt.Errorf("TLS block of %#x bytes does not fit in memory", tls.Memsz)
+	}
+	tp := (uint64(block) + align - 1) &^ (align - 1)
+
+	image := make([]uint8, tls.Memsz)
+	if err := e.copyBytes(VirtAddr(tls.Vaddr+e.program.bias), image[:tls.Filesz]); err != nil {
+		return err
+	}
+	if err := e.WriteFrom(VirtAddr(tp), image); err != nil {
+		return err
+	}
+	e.TrackAllocation(VirtAddr(tp), uint(tls.Memsz), "tls")
+	e.SetReg(Tp, tp)
+	return nil
+}
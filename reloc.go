@@ -0,0 +1,87 @@
+// position independent executables - moving a program away from the address
+// it was linked at and fixing up the pointers in it.
+package main
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+)
+
+// PIE_BASE is where position independent executables are loaded, it is clear
+// of the first allocations made by the Mmu.
+const PIE_BASE = 0x10000
+
+// rebase moves the program `bias` bytes up from the addresses it was linked at
+func (p *ElfBinary) rebase(bias uint64) {
+	p.bias = bias
+	p.entry += bias
+	if p.phdr != 0 {
+		p.phdr += bias
+	}
+	for i := range p.symbols {
+		p.symbols[i].Value += bias
+	}
+}
+
+// dynamicEntries returns the tags and values in the dynamic section
+func (p *ElfBinary) dynamicEntries(contents []uint8) (map[elf.DynTag]uint64, error) {
+	dyn := p.dynamic
+	entries := make(map[elf.DynTag]uint64)
+	if dyn.Type != elf.PT_DYNAMIC {
+		return entries, nil
+	}
+	if dyn.Off+dyn.Filesz > uint64(len(contents)) || dyn.Off+dyn.Filesz < dyn.Off {
+		return nil, LoaderError{p.path, "dynamic segment outside of file"}
+	}
+
+	raw := contents[dyn.Off : dyn.Off+dyn.Filesz]
+	for i := 0; i+16 <= len(raw); i += 16 {
+		tag := elf.DynTag(binary.LittleEndian.Uint64(raw[i:]))
+		if tag == elf.DT_NULL {
+			break
+		}
+		entries[tag] = binary.LittleEndian.Uint64(raw[i+8:])
+	}
+	return entries, nil
+}
+
+// relocate applies the dynamic relocations of a position independent
+// executable. Only R_RISCV_RELATIVE is supported, which is all a static-pie
+// program needs.
+func (e *Emulator) relocate(contents []uint8) error {
+	dyn, err := e.program.dynamicEntries(contents)
+	if err != nil {
+		return err
+	}
+	rela, size := dyn[elf.DT_RELA], dyn[elf.DT_RELASZ]
+	if rela == 0 || size == 0 {
+		return nil
+	}
+	entSize := dyn[elf.DT_RELAENT]
+	if entSize == 0 {
+		entSize = 24
+	}
+
+	bias := e.program.bias
+	buf := make([]uint8, size)
+	if err := e.copyBytes(VirtAddr(rela+bias), buf); err != nil {
+		return LoaderError{e.program.path, fmt.Sprintf("relocations at %#x outside of memory", rela+bias)}
+	}
+	for i := uint64(0); i+24 <= size; i += entSize {
+		offset := binary.LittleEndian.Uint64(buf[i:])
+		info := binary.LittleEndian.Uint64(buf[i+8:])
+		addend := binary.LittleEndian.Uint64(buf[i+16:])
+
+		switch typ := elf.R_RISCV(elf.R_TYPE64(info)); typ {
+		case elf.R_RISCV_NONE:
+		case elf.R_RISCV_RELATIVE:
+			if err := WriteFromVal(e.Mmu, VirtAddr(offset+bias), bias+addend); err != nil {
+				return err
+			}
+		default:
+			return LoaderError{e.program.path, fmt.Sprintf("unsupported relocation %s at %#x", typ, offset)}
+		}
+	}
+	return nil
+}
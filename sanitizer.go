@@ -0,0 +1,348 @@
+// heap sanitizer - replaces the program's allocator with one that surrounds
+// every allocation with inaccessible memory so heap bugs fault immediately.
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// REDZONE_SIZE is the amount of inaccessible memory on both sides of a
+	// sanitized allocation
+	REDZONE_SIZE = 0x20
+
+	// QUARANTINE_SIZE is the number of freed bytes held back from reuse
+	QUARANTINE_SIZE = 0x10000
+
+	// MAX_BACKTRACE is the deepest call stack kept by the emulator
+	MAX_BACKTRACE = 0x100
+)
+
+// HeapErrType represents the types of heap misuse caught by the sanitizer
+type HeapErrType int
+
+const (
+	ErrHeapOverflow HeapErrType = iota // access outside of an allocation
+	ErrUseAfterFree                    // access to a freed allocation
+	ErrDoubleFree                      // free of an already freed allocation
+	ErrInvalidFree                     // free of a pointer never allocated
+)
+
+// HeapError describes a heap misuse, where the memory involved came from and
+// where it was released.
+type HeapError struct {
+	typ   HeapErrType
+	addr  VirtAddr
+	base  VirtAddr
+	size  uint
+	alloc string
+	free  string
+}
+
+func (h HeapError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "HeapError{typ: %s, addr: %#x, chunk: [%#x -> %#x]}",
+		h.typ, h.addr, h.base, uint(h.base)+h.size)
+	if h.alloc != "" {
+		fmt.Fprintf(&b, "\n\tallocated at:\n%s", h.alloc)
+	}
+	if h.free != "" {
+		fmt.Fprintf(&b, "\n\tfreed at:\n%s", h.free)
+	}
+	return b.String()
+}
+
+// Backtrace is a list of call sites, innermost first
+type Backtrace []uint64
+
+// format the backtrace using the symbols of the program
+func (bt Backtrace) format(prog *ElfBinary) string {
+	var b strings.Builder
+	for i, pc := range bt {
+		fmt.Fprintf(&b, "\t\t#%d %#x %s\n", i, pc, prog.symbolize(pc))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// symbolize returns `func+offset` for the function containing pc
+func (p *ElfBinary) symbolize(pc uint64) string {
+	i := sort.Search(len(p.symbols), func(i int) bool {
+		return p.symbols[i].Value > pc
+	})
+	if i == 0 {
+		return "??"
+	}
+	sym := p.symbols[i-1]
+	if sym.Size != 0 && pc >= sym.Value+sym.Size {
+		return "??"
+	}
+	return fmt.Sprintf("%s+%#x", sym.Name, pc-sym.Value)
+}
+
+// backtrace returns the call sites of the functions currently executing
+func (e *Emulator) backtrace() Backtrace {
+	bt := make(Backtrace, 0, len(e.callstack))
+	for i := len(e.callstack) - 1; i >= 0; i-- {
+		bt = append(bt, e.callstack[i]-4)
+	}
+	return bt
+}
+
+// track calls and returns made through jal and jalr so backtraces can be
+// produced without unwinding the guest stack.
+func (e *Emulator) trackCall(rd, rs1 Register, pc uint64) {
+	switch {
+	case rd == Ra:
+		if len(e.callstack) == MAX_BACKTRACE {
+			e.callstack = e.callstack[1:]
+		}
+		e.callstack = append(e.callstack, pc+4)
+	case rd == Zero && rs1 == Ra && len(e.callstack) > 0:
+		e.callstack = e.callstack[:len(e.callstack)-1]
+	}
+}
+
+// chunk is a single sanitized allocation
+type chunk struct {
+	region     VirtAddr // start of the left redzone
+	regionSize uint
+	base       VirtAddr // pointer handed to the program
+	size       uint
+	freed      bool
+	alloc      Backtrace
+	free       Backtrace
+}
+
+// Sanitizer is an allocator for the program's heap that makes overflows,
+// use-after-free and double-free observable.
+type Sanitizer struct {
+	chunks     map[VirtAddr]*chunk
+	quarantine []*chunk
+	held       uint // bytes in quarantine
+	reusable   []*chunk
+}
+
+func NewSanitizer() *Sanitizer {
+	return &Sanitizer{chunks: make(map[VirtAddr]*chunk)}
+}
+
+// Fork creates a copy of the sanitizer state
+func (s *Sanitizer) Fork() *Sanitizer {
+	fork := &Sanitizer{chunks: make(map[VirtAddr]*chunk, len(s.chunks)), held: s.held}
+	copies := make(map[*chunk]*chunk, len(s.chunks))
+	for base, c := range s.chunks {
+		cc := *c
+		copies[c] = &cc
+		fork.chunks[base] = &cc
+	}
+	for _, c := range s.quarantine {
+		fork.quarantine = append(fork.quarantine, copies[c])
+	}
+	for _, c := range s.reusable {
+		fork.reusable = append(fork.reusable, copies[c])
+	}
+	return fork
+}
+
+// hookSanitizer replaces the allocator functions found in the program's symbol
+// table with the sanitizer.
+func (e *Emulator) hookSanitizer() {
+	e.san = NewSanitizer()
+	hooks := map[string]func(*Emulator) error{
+		"malloc":  (*Emulator).sanMalloc,
+		"free":    (*Emulator).sanFree,
+		"calloc":  (*Emulator).sanCalloc,
+		"realloc": (*Emulator).sanRealloc,
+	}
+	for _, sym := range e.program.symbols {
+		if hook, ok := hooks[sym.Name]; ok {
+			e.Hook(VirtAddr(sym.Value), hook)
+		}
+	}
+}
+
+// allocate `size` bytes surrounded by redzones
+func (e *Emulator) sanAlloc(size uint) VirtAddr {
+	// the chunk and its redzones have to fit in the address space
+	if size > ^uint(0)-0xf-2*REDZONE_SIZE {
+		return 0
+	}
+	user := (size + 0xf) &^ 0xf
+	if user == 0 {
+		user = 0x10
+	}
+	need := REDZONE_SIZE + user + REDZONE_SIZE
+
+	var c *chunk
+	for i, r := range e.san.reusable {
+		if r.regionSize >= need {
+			c = r
+			e.san.reusable = append(e.san.reusable[:i], e.san.reusable[i+1:]...)
+			break
+		}
+	}
+	if c == nil {
+		region := e.AllocatePerms(need, 0)
+		if region == 0 {
+			return 0
+		}
+		c = &chunk{region: region, regionSize: need}
+	}
+	delete(e.san.chunks, c.base)
+
+	c.base = c.region + REDZONE_SIZE
+	c.size = size
+	c.freed = false
+	c.alloc = e.backtrace()
+	c.free = nil
+	e.san.chunks[c.base] = c
+
+	e.SetPermissions(c.region, c.regionSize, 0)
+	e.SetPermissions(c.base, size, allocPerm())
+	e.TrackAllocation(c.base, size, fmt.Sprintf("malloc at pc %#x", e.Reg(Ra)-4))
+	return c.base
+}
+
+// release the chunk at `addr`, poisoning it and putting it in quarantine
+func (e *Emulator) sanRelease(addr VirtAddr) error {
+	c, ok := e.san.chunks[addr]
+	if !ok {
+		return HeapError{typ: ErrInvalidFree, addr: addr, base: addr}
+	}
+	if c.freed {
+		return e.san.report(ErrDoubleFree, addr, c, &e.program)
+	}
+	c.freed = true
+	c.free = e.backtrace()
+	e.SetPermissions(c.region, c.regionSize, 0)
+
+	e.san.quarantine = append(e.san.quarantine, c)
+	e.san.held += c.regionSize
+	for e.san.held > QUARANTINE_SIZE && len(e.san.quarantine) > 0 {
+		old := e.san.quarantine[0]
+		e.san.quarantine = e.san.quarantine[1:]
+		e.san.held -= old.regionSize
+		e.san.reusable = append(e.san.reusable, old)
+	}
+	return nil
+}
+
+// void *malloc(size_t size);
+func (e *Emulator) sanMalloc() error {
+	e.hookReturn(uint64(e.sanAlloc(uint(e.Reg(A0)))))
+	return nil
+}
+
+// void free(void *ptr);
+func (e *Emulator) sanFree() error {
+	if addr := VirtAddr(e.Reg(A0)); addr != 0 {
+		if err := e.sanRelease(addr); err != nil {
+			return err
+		}
+	}
+	e.hookReturn(0)
+	return nil
+}
+
+// void *calloc(size_t nmemb, size_t size);
+func (e *Emulator) sanCalloc() error {
+	n, size := e.Reg(A0), e.Reg(A1)
+	if size != 0 && n > ^uint64(0)/size {
+		e.hookReturn(0)
+		return nil
+	}
+	addr := e.sanAlloc(uint(n * size))
+	if addr != 0 {
+		if err := e.WriteFrom(addr, make([]uint8, n*size)); err != nil {
+			return err
+		}
+	}
+	e.hookReturn(uint64(addr))
+	return nil
+}
+
+// void *realloc(void *ptr, size_t size);
+func (e *Emulator) sanRealloc() error {
+	old, size := VirtAddr(e.Reg(A0)), uint(e.Reg(A1))
+	if old == 0 {
+		return e.sanMalloc()
+	}
+
+	c, ok := e.san.chunks[old]
+	if !ok {
+		return HeapError{typ: ErrInvalidFree, addr: old, base: old}
+	}
+	if c.freed {
+		return e.san.report(ErrUseAfterFree, old, c, &e.program)
+	}
+	if size == 0 {
+		return e.sanFree()
+	}
+
+	addr := e.sanAlloc(size)
+	if addr == 0 {
+		e.hookReturn(0)
+		return nil
+	}
+	buf := make([]uint8, c.size)
+	if size < c.size {
+		buf = buf[:size]
+	}
+	if err := e.copyBytes(old, buf); err != nil {
+		return err
+	}
+	if err := e.WriteFrom(addr, buf); err != nil {
+		return err
+	}
+	if err := e.sanRelease(old); err != nil {
+		return err
+	}
+	e.hookReturn(uint64(addr))
+	return nil
+}
+
+// report builds the error for a misuse of chunk `c` at `addr`
+func (s *Sanitizer) report(typ HeapErrType, addr VirtAddr, c *chunk, prog *ElfBinary) HeapError {
+	err := HeapError{typ: typ, addr: addr, base: c.base, size: c.size, alloc: c.alloc.format(prog)}
+	if c.freed {
+		err.free = c.free.format(prog)
+	}
+	return err
+}
+
+// classify turns a memory fault that hit sanitizer managed memory into a
+// HeapError, any other error is returned unchanged.
+func (e *Emulator) classify(err error) error {
+	merr, ok := err.(MMUError)
+	if e.san == nil || !ok || merr.typ != ErrPerms {
+		return err
+	}
+	start, end := merr.addr, merr.addr+VirtAddr(max(merr.size, 1))
+	for _, c := range e.san.chunks {
+		if start >= c.region+VirtAddr(c.regionSize) || end <= c.region {
+			continue
+		}
+		typ := ErrHeapOverflow
+		if c.freed {
+			typ = ErrUseAfterFree
+		}
+		return e.san.report(typ, merr.addr, c, &e.program)
+	}
+	return err
+}
+
+// funcSymbols returns the function symbols of the binary sorted by address
+func funcSymbols(bin *elf.File) []elf.Symbol {
+	syms, _ := bin.Symbols()
+	funcs := make([]elf.Symbol, 0, len(syms))
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+			funcs = append(funcs, sym)
+		}
+	}
+	sort.Slice(funcs, func(i, j int) bool { return funcs[i].Value < funcs[j].Value })
+	return funcs
+}
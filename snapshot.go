@@ -0,0 +1,693 @@
+// emulator snapshots - save the state of a running program to disk and resume
+// it in a later session.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// A snapshot file looks like this, all integers are little-endian
+//
+//	magic   [8]byte  "SIMPSNAP"
+//	version uint32
+//	digest  [32]byte sha256 of the uncompressed payload
+//	payload gzip compressed emulator state
+const (
+	SNAPSHOT_MAGIC   = "SIMPSNAP"
+	SNAPSHOT_VERSION = 1
+
+	// the most memory a snapshot is loaded into, a larger size is taken for
+	// a corrupt file rather than allocated
+	SNAPSHOT_MAX_MEM = 1 << 34
+)
+
+// SnapshotError is returned when a snapshot file can't be used
+type SnapshotError struct {
+	path   string
+	reason string
+}
+
+func (s SnapshotError) Error() string {
+	return fmt.Sprintf("snapshot %s: %s", s.path, s.reason)
+}
+
+// how an open file description is restored from a snapshot
+const (
+	SNAP_FILE_FS     = iota // opened again from the filesystem by its path
+	SNAP_FILE_STREAM        // a standard stream of the host
+	SNAP_FILE_MEM           // a file of the saved memory filesystem
+	SNAP_FILE_BYTES         // fixed contents saved with the snapshot
+	SNAP_FILE_HOST          // a host file given to the emulator, opened again read only
+)
+
+// snapWriter encodes values into the snapshot payload, the first error sticks
+type snapWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (s *snapWriter) val(v any) {
+	if s.err == nil {
+		s.err = binary.Write(s.w, binary.LittleEndian, v)
+	}
+}
+
+func (s *snapWriter) str(str string) {
+	s.val(uint32(len(str)))
+	if s.err == nil {
+		_, s.err = io.WriteString(s.w, str)
+	}
+}
+
+func (s *snapWriter) prog(hdr elf.ProgHeader) {
+	s.val([]uint64{uint64(hdr.Type), uint64(hdr.Flags), hdr.Off, hdr.Vaddr,
+		hdr.Paddr, hdr.Filesz, hdr.Memsz, hdr.Align})
+}
+
+func (s *snapWriter) backtrace(bt Backtrace) {
+	s.val(uint32(len(bt)))
+	s.val([]uint64(bt))
+}
+
+// snapReader decodes values from the snapshot payload, the first error sticks
+type snapReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (s *snapReader) val(v any) {
+	if s.err == nil {
+		s.err = binary.Read(s.r, binary.LittleEndian, v)
+	}
+}
+
+func (s *snapReader) u64() (v uint64) {
+	s.val(&v)
+	return v
+}
+
+func (s *snapReader) u32() (v uint32) {
+	s.val(&v)
+	return v
+}
+
+// count reads the number of items that follow, each at least `size` bytes.
+// A count the rest of the payload can't hold is an error, nothing is
+// allocated for it.
+func (s *snapReader) count(size int) uint32 {
+	n := s.u32()
+	if s.err == nil && uint64(n)*uint64(size) > uint64(s.r.Len()) {
+		s.err = fmt.Errorf("%d items don't fit in the %d bytes left", n, s.r.Len())
+	}
+	if s.err != nil {
+		return 0
+	}
+	return n
+}
+
+func (s *snapReader) str() string {
+	n := s.count(1)
+	if s.err != nil {
+		return ""
+	}
+	buf := make([]byte, n)
+	_, s.err = io.ReadFull(s.r, buf)
+	return string(buf)
+}
+
+func (s *snapReader) prog() elf.ProgHeader {
+	var f [8]uint64
+	s.val(&f)
+	return elf.ProgHeader{
+		Type: elf.ProgType(f[0]), Flags: elf.ProgFlag(f[1]), Off: f[2],
+		Vaddr: f[3], Paddr: f[4], Filesz: f[5], Memsz: f[6], Align: f[7],
+	}
+}
+
+func (s *snapReader) backtrace() Backtrace {
+	n := s.count(8)
+	if s.err != nil {
+		return nil
+	}
+	bt := make(Backtrace, n)
+	s.val([]uint64(bt))
+	return bt
+}
+
+// SaveSnapshot writes the complete state of the emulator to `path`. Hooks
+// other than the sanitizer's are not saved.
+func (e *Emulator) SaveSnapshot(path string) error {
+	var payload bytes.Buffer
+	w := &snapWriter{w: &payload}
+
+	// program
+	w.str(e.program.path)
+	w.str(e.program.name)
+	w.val(uint32(len(e.program.args)))
+	for _, arg := range e.program.args {
+		w.str(arg)
+	}
+	w.val([]uint64{e.program.entry, e.program.phdr, e.program.phnum, e.program.bias})
+	w.val(uint32(len(e.program.segments)))
+	for _, seg := range e.program.segments {
+		w.prog(seg)
+	}
+	w.prog(e.program.dynamic)
+	w.prog(e.program.tls)
+	w.str(e.program.interp)
+	w.val([]uint64{e.program.interpBase, e.program.interpEntry})
+
+	// symbols of the program and its interpreter, already relocated
+	w.val(uint32(len(e.program.symbols)))
+	for _, sym := range e.program.symbols {
+		w.str(sym.Name)
+		w.val([]uint8{sym.Info, sym.Other})
+		w.val([]uint64{uint64(sym.Section), sym.Value, sym.Size})
+	}
+
+	// execution state
+	w.val(e.registers)
+	w.val(uint64(e.programBrk))
+	w.val(uint64(e.initialBrk))
+	w.val(e.icount)
+	w.val(e.misaligned)
+	w.val(uint64(e.tidAddress))
+	w.val(uint32(len(e.callstack)))
+	w.val(e.callstack)
+
+	// sanitizer, its hooks are installed again from the symbols
+	w.val(e.san != nil)
+	if e.san != nil {
+		e.san.save(w)
+	}
+
+	e.files.save(w)
+
+	// memory
+	m := e.Mmu
+	w.val([]uint64{uint64(m.size), uint64(m.curAlloc), uint64(m.stack),
+		uint64(m.heap), uint64(m.programStart), uint64(m.guard), uint64(m.allocLimit)})
+	w.val(uint32(len(m.allocs)))
+	for _, a := range m.allocs {
+		w.val([]uint64{uint64(a.base), uint64(a.size)})
+		w.str(a.site)
+	}
+	var used []uint32
+	for i, p := range m.pages {
+		if p != zeroPage && *p != *zeroPage {
+			used = append(used, uint32(i))
+		}
+	}
+	w.val(uint32(len(used)))
+	for _, i := range used {
+		w.val(i)
+		w.val(m.pages[i].data)
+		w.val(m.pages[i].perms)
+	}
+	if w.err != nil {
+		return w.err
+	}
+
+	var out bytes.Buffer
+	digest := sha256.Sum256(payload.Bytes())
+	hdr := &snapWriter{w: &out}
+	hdr.val([]byte(SNAPSHOT_MAGIC))
+	hdr.val(uint32(SNAPSHOT_VERSION))
+	hdr.val(digest)
+	if hdr.err != nil {
+		return hdr.err
+	}
+	zw := gzip.NewWriter(&out)
+	if _, err := zw.Write(payload.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return os.WriteFile(path, out.Bytes(), 0644)
+}
+
+// save writes the sanitizer's chunks, quarantine and reusable chunks refer
+// to them by index
+func (s *Sanitizer) save(w *snapWriter) {
+	chunks := make([]*chunk, 0, len(s.chunks))
+	for _, c := range s.chunks {
+		chunks = append(chunks, c)
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].region < chunks[j].region })
+	index := make(map[*chunk]uint32, len(chunks))
+
+	w.val(uint32(len(chunks)))
+	for i, c := range chunks {
+		index[c] = uint32(i)
+		w.val([]uint64{uint64(c.region), uint64(c.regionSize), uint64(c.base), uint64(c.size)})
+		w.val(c.freed)
+		w.backtrace(c.alloc)
+		w.backtrace(c.free)
+	}
+	w.val(uint64(s.held))
+	for _, list := range [][]*chunk{s.quarantine, s.reusable} {
+		w.val(uint32(len(list)))
+		for _, c := range list {
+			w.val(index[c])
+		}
+	}
+}
+
+// save writes the working directory, the open file descriptions and the
+// descriptors referring to them. A memory filesystem is saved with
+// everything in it.
+func (t *FileTable) save(w *snapWriter) {
+	w.str(t.cwd)
+	var (
+		descs []*openFile
+		index = make(map[*openFile]uint32)
+		open  []*memNode
+	)
+	fds := make([]int, 0, len(t.fds))
+	for fd := range t.fds {
+		fds = append(fds, fd)
+	}
+	sort.Ints(fds)
+	for _, fd := range fds {
+		f := t.fds[fd]
+		if _, ok := index[f]; !ok {
+			index[f] = uint32(len(descs))
+			descs = append(descs, f)
+			if mf, ok := f.File.(*memFile); ok {
+				open = append(open, mf.node)
+			}
+		}
+	}
+
+	mem, ok := t.fs.(*MemFS)
+	w.val(ok)
+	var nodes map[*memNode]uint32
+	if ok {
+		nodes = mem.save(w, open)
+	}
+
+	w.val(uint32(len(descs)))
+	for _, f := range descs {
+		w.str(f.path)
+		w.val([]int64{int64(f.flags), f.off})
+		w.val(f.stream)
+		w.val(uint32(len(f.dirents)))
+		for _, ent := range f.dirents {
+			w.str(ent.name)
+			w.val(ent.ino)
+			w.val(ent.typ)
+		}
+		switch file := f.File.(type) {
+		case *stream:
+			w.val(uint8(SNAP_FILE_STREAM))
+		case *memFile:
+			if idx, ok := nodes[file.node]; ok {
+				w.val(uint8(SNAP_FILE_MEM))
+				w.val(idx)
+			} else {
+				w.val(uint8(SNAP_FILE_FS))
+			}
+		case *bytesFile:
+			w.val(uint8(SNAP_FILE_BYTES))
+			w.str(string(file.data))
+		case *hostFile:
+			w.val(uint8(SNAP_FILE_HOST))
+			w.str(file.Name())
+		default:
+			w.val(uint8(SNAP_FILE_FS))
+		}
+	}
+	w.val(uint32(len(fds)))
+	for _, fd := range fds {
+		w.val([]uint32{uint32(fd), index[t.fds[fd]]})
+	}
+}
+
+// save writes the nodes of the filesystem and of the `open` files, then the
+// names of both layers. It returns the index of every node written.
+func (m *MemFS) save(w *snapWriter, open []*memNode) map[*memNode]uint32 {
+	var (
+		nodes []*memNode
+		index = make(map[*memNode]uint32)
+	)
+	add := func(node *memNode) {
+		if _, ok := index[node]; node != nil && !ok {
+			index[node] = uint32(len(nodes))
+			nodes = append(nodes, node)
+		}
+	}
+	layers := []map[string]*memNode{m.lower, m.upper}
+	names := make([][]string, len(layers))
+	for i, layer := range layers {
+		for name := range layer {
+			names[i] = append(names[i], name)
+		}
+		sort.Strings(names[i])
+		for _, name := range names[i] {
+			add(layer[name])
+		}
+	}
+	for _, node := range open {
+		add(node)
+	}
+
+	w.val(uint32(len(nodes)))
+	for _, node := range nodes {
+		w.str(string(node.data))
+		w.val(uint32(node.mode))
+		w.val(node.modTime.UnixNano())
+		w.val(node.lower)
+	}
+	for i, layer := range layers {
+		w.val(uint32(len(names[i])))
+		for _, name := range names[i] {
+			w.str(name)
+			idx := int64(-1)
+			if node := layer[name]; node != nil {
+				idx = int64(index[node])
+			}
+			w.val(idx)
+		}
+	}
+	return index
+}
+
+// LoadSnapshot creates an emulator from the snapshot at `path`, execution
+// resumes from where the snapshot was taken. A memory filesystem is restored
+// from the snapshot, files of any other filesystem are opened again from
+// `fsys`.
+func LoadSnapshot(path string, fsys FS) (*Emulator, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		magic   [8]byte
+		version uint32
+		digest  [32]byte
+	)
+	hdr := &snapReader{r: bytes.NewReader(data)}
+	hdr.val(&magic)
+	hdr.val(&version)
+	hdr.val(&digest)
+	if hdr.err != nil || string(magic[:]) != SNAPSHOT_MAGIC {
+		return nil, SnapshotError{path, "not a snapshot file"}
+	}
+	if version != SNAPSHOT_VERSION {
+		return nil, SnapshotError{path, fmt.Sprintf("unsupported version %d", version)}
+	}
+
+	zr, err := gzip.NewReader(hdr.r)
+	if err != nil {
+		return nil, SnapshotError{path, err.Error()}
+	}
+	payload, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, SnapshotError{path, err.Error()}
+	}
+	if sha256.Sum256(payload) != digest {
+		return nil, SnapshotError{path, "digest mismatch, file is corrupt"}
+	}
+
+	r := &snapReader{r: bytes.NewReader(payload)}
+	var n uint32
+
+	// program
+	var prog ElfBinary
+	prog.path = r.str()
+	prog.name = r.str()
+	r.val(&n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		prog.args = append(prog.args, r.str())
+	}
+	var layout [4]uint64
+	r.val(&layout)
+	prog.entry, prog.phdr, prog.phnum, prog.bias = layout[0], layout[1], layout[2], layout[3]
+	r.val(&n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		prog.segments = append(prog.segments, r.prog())
+	}
+	prog.dynamic = r.prog()
+	prog.tls = r.prog()
+	prog.interp = r.str()
+	prog.interpBase = r.u64()
+	prog.interpEntry = r.u64()
+	r.val(&n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		sym := elf.Symbol{Name: r.str()}
+		var b [2]uint8
+		var f [3]uint64
+		r.val(&b)
+		r.val(&f)
+		sym.Info, sym.Other = b[0], b[1]
+		sym.Section, sym.Value, sym.Size = elf.SectionIndex(f[0]), f[1], f[2]
+		prog.symbols = append(prog.symbols, sym)
+	}
+
+	// execution state
+	var (
+		regs       [33]uint64
+		misaligned [3]uint64
+	)
+	r.val(&regs)
+	brk := r.u64()
+	initialBrk := r.u64()
+	icount := r.u64()
+	r.val(&misaligned)
+	tidAddress := r.u64()
+	n = r.count(8)
+	callstack := make([]uint64, n)
+	r.val(callstack)
+
+	var (
+		hasSan bool
+		san    *Sanitizer
+	)
+	r.val(&hasSan)
+	if hasSan {
+		san = loadSanitizer(r)
+	}
+
+	files, err := loadFiles(r, fsys)
+	if err != nil {
+		return nil, SnapshotError{path, err.Error()}
+	}
+
+	// memory
+	var mem [7]uint64
+	r.val(&mem)
+	if r.err != nil {
+		return nil, SnapshotError{path, r.err.Error()}
+	}
+	if mem[0] > SNAPSHOT_MAX_MEM {
+		return nil, SnapshotError{path, fmt.Sprintf("memory size %#x too large", mem[0])}
+	}
+	for _, addr := range mem[1:] {
+		if addr > mem[0] {
+			return nil, SnapshotError{path, fmt.Sprintf("address %#x outside of memory", addr)}
+		}
+	}
+	emu := NewEmulator(uint(mem[0]))
+	m := emu.Mmu
+	m.curAlloc = VirtAddr(mem[1])
+	m.stack = VirtAddr(mem[2])
+	m.heap = VirtAddr(mem[3])
+	m.programStart = VirtAddr(mem[4])
+	m.guard = VirtAddr(mem[5])
+	m.allocLimit = VirtAddr(mem[6])
+	r.val(&n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		var a [2]uint64
+		r.val(&a)
+		m.TrackAllocation(VirtAddr(a[0]), uint(a[1]), r.str())
+	}
+	r.val(&n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		var idx uint32
+		r.val(&idx)
+		if int(idx) >= len(m.pages) {
+			return nil, SnapshotError{path, fmt.Sprintf("page %d out of range", idx)}
+		}
+		p := m.writablePage(int(idx))
+		r.val(&p.data)
+		r.val(&p.perms)
+	}
+	if r.err != nil {
+		return nil, SnapshotError{path, r.err.Error()}
+	}
+
+	emu.program = prog
+	emu.programBrk = VirtAddr(brk)
+	emu.initialBrk = VirtAddr(initialBrk)
+	emu.registers = regs
+	emu.icount = icount
+	emu.misaligned = misaligned
+	emu.tidAddress = VirtAddr(tidAddress)
+	emu.callstack = callstack
+	emu.files = files
+	if san != nil {
+		emu.hookSanitizer()
+		emu.san = san
+	}
+	return emu, nil
+}
+
+// loadSanitizer reads the sanitizer state written by Sanitizer.save
+func loadSanitizer(r *snapReader) *Sanitizer {
+	s := NewSanitizer()
+	n := r.count(1)
+	chunks := make([]*chunk, 0, n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		var f [4]uint64
+		r.val(&f)
+		c := &chunk{region: VirtAddr(f[0]), regionSize: uint(f[1]), base: VirtAddr(f[2]), size: uint(f[3])}
+		r.val(&c.freed)
+		c.alloc = r.backtrace()
+		c.free = r.backtrace()
+		chunks = append(chunks, c)
+		s.chunks[c.base] = c
+	}
+	s.held = uint(r.u64())
+	for _, list := range []*[]*chunk{&s.quarantine, &s.reusable} {
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			if idx := r.u32(); int(idx) < len(chunks) {
+				*list = append(*list, chunks[idx])
+			}
+		}
+	}
+	return s
+}
+
+// loadFiles reads the file table written by FileTable.save, files that can't
+// be opened again are an error
+func loadFiles(r *snapReader, fsys FS) (*FileTable, error) {
+	cwd := r.str()
+	var (
+		hasMem bool
+		nodes  []*memNode
+	)
+	r.val(&hasMem)
+	if hasMem {
+		var mem *MemFS
+		mem, nodes = loadMemFS(r)
+		fsys = mem
+	}
+	files := NewFileTable(fsys, nil, nil, nil)
+	files.cwd = cwd
+
+	n := r.count(1)
+	descs := make([]*openFile, 0, n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		name := r.str()
+		var (
+			f        [2]int64
+			isStream bool
+			kind     uint8
+			file     File
+			err      error
+		)
+		r.val(&f)
+		r.val(&isStream)
+		var dirents []dirent
+		for j, m := uint32(0), r.u32(); j < m && r.err == nil; j++ {
+			ent := dirent{name: r.str()}
+			r.val(&ent.ino)
+			r.val(&ent.typ)
+			dirents = append(dirents, ent)
+		}
+		r.val(&kind)
+		flags := int(f[0])
+		switch kind {
+		case SNAP_FILE_STREAM:
+			switch name {
+			case "/dev/stdin":
+				file = &stream{name: "stdin", r: os.Stdin}
+			case "/dev/stdout":
+				file = &stream{name: "stdout", w: os.Stdout}
+			case "/dev/stderr":
+				file = &stream{name: "stderr", w: os.Stderr}
+			default:
+				err = ENOENT
+			}
+		case SNAP_FILE_MEM:
+			if idx := r.u32(); hasMem && int(idx) < len(nodes) {
+				file = &memFile{fsys.(*MemFS), name, nodes[idx]}
+			} else {
+				err = ENOENT
+			}
+		case SNAP_FILE_BYTES:
+			file = &bytesFile{path.Base(name), []uint8(r.str())}
+		case SNAP_FILE_HOST:
+			var host *os.File
+			if host, err = os.Open(r.str()); err == nil {
+				file = &hostFile{host}
+			}
+		default:
+			file, err = fsys.OpenFile(name, flags&^(O_CREAT|O_EXCL|O_TRUNC), 0)
+		}
+		if r.err != nil {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can't open %s again: %w", name, err)
+		}
+		descs = append(descs, &openFile{handle: &handle{File: file, refs: 1}, path: name,
+			flags: flags, off: f[1], stream: isStream, dirents: dirents})
+	}
+	n = r.u32()
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		var fd [2]uint32
+		r.val(&fd)
+		if int(fd[1]) >= len(descs) {
+			return nil, fmt.Errorf("descriptor %d refers to unknown file %d", fd[0], fd[1])
+		}
+		descs[fd[1]].refs++
+		files.fds[int(fd[0])] = descs[fd[1]]
+	}
+	return files, nil
+}
+
+// loadMemFS reads the filesystem written by MemFS.save and its nodes
+func loadMemFS(r *snapReader) (*MemFS, []*memNode) {
+	m := &MemFS{lower: make(map[string]*memNode), upper: make(map[string]*memNode)}
+	n := r.count(1)
+	nodes := make([]*memNode, 0, n)
+	for i := uint32(0); i < n && r.err == nil; i++ {
+		node := &memNode{data: []uint8(r.str())}
+		node.mode = fs.FileMode(r.u32())
+		var mtime int64
+		r.val(&mtime)
+		node.modTime = time.Unix(0, mtime)
+		r.val(&node.lower)
+		nodes = append(nodes, node)
+	}
+	for _, layer := range []map[string]*memNode{m.lower, m.upper} {
+		n := r.u32()
+		for i := uint32(0); i < n && r.err == nil; i++ {
+			name := r.str()
+			var idx int64
+			r.val(&idx)
+			switch {
+			case idx < 0:
+				layer[name] = nil
+			case idx < int64(len(nodes)):
+				layer[name] = nodes[idx]
+			}
+		}
+	}
+	return m, nodes
+}
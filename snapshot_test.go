@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// runToExit runs `e` with its standard output going to `out` until the
+// program exits
+func runToExit(t *testing.T, e *Emulator, out *bytes.Buffer) Done {
+	t.Helper()
+	e.files.SetStream(1, nil, out)
+	err := e.Run()
+	exit, ok := err.(EmuExit)
+	if !ok {
+		t.Fatalf("run: %v", err)
+	}
+	done, ok := exit.cause.(Done)
+	if !ok {
+		t.Fatalf("run: %v", err)
+	}
+	return done
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	fsys := NewMemFS()
+	e := NewEmulator(MEM_SIZE)
+	e.SetFS(fsys)
+	if err := e.MapProgram("testdata/musl/hello/hello", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	e.StdinBytes([]uint8("input"))
+	e.BreakAfter(100)
+	err := e.Run()
+	if exit, ok := err.(EmuExit); !ok {
+		t.Fatalf("run: %v", err)
+	} else if _, ok := exit.cause.(Breakpoint); !ok {
+		t.Fatalf("run: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := e.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSnapshot(path, NewMemFS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.registers != e.registers || loaded.icount != e.icount {
+		t.Fatal("loaded registers differ from the saved ones")
+	}
+	if loaded.programBrk != e.programBrk || loaded.curAlloc != e.curAlloc {
+		t.Fatal("loaded memory layout differs from the saved one")
+	}
+
+	// both run the rest of the program the same way
+	var want, got bytes.Buffer
+	wantExit := runToExit(t, e, &want)
+	gotExit := runToExit(t, loaded, &got)
+	if gotExit != wantExit {
+		t.Errorf("loaded program %v, want %v", gotExit, wantExit)
+	}
+	if got.String() != want.String() {
+		t.Errorf("loaded program printed %q, want %q", got.String(), want.String())
+	}
+	if want.Len() == 0 {
+		t.Error("program printed nothing after the snapshot")
+	}
+	if loaded.icount != e.icount || loaded.registers != e.registers {
+		t.Error("loaded program ended in a different state")
+	}
+}
+
+func TestLoadSnapshotCorrupt(t *testing.T) {
+	e := NewEmulator(MEM_SIZE)
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := e.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSnapshot(path, NewMemFS()); err == nil {
+		t.Fatal("loaded a corrupt snapshot")
+	}
+}
+
+func TestSnapshotReaderCount(t *testing.T) {
+	// a count larger than the payload fails before anything is allocated
+	w := &snapWriter{w: new(bytes.Buffer)}
+	w.val(uint32(1 << 31))
+	w.val(uint64(0))
+	r := &snapReader{r: bytes.NewReader(w.w.(*bytes.Buffer).Bytes())}
+	if bt := r.backtrace(); bt != nil || r.err == nil {
+		t.Fatalf("read a backtrace of %d entries", len(bt))
+	}
+}
+
+func TestSnapshotHostFiles(t *testing.T) {
+	// files of the host filesystem are opened again by their path in the
+	// sandbox, wherever the sandbox is when the snapshot is loaded
+	saved, moved := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(saved, "data"), []uint8("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(moved, "data"), []uint8("abcdefghij"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := NewHostFS(saved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEmulator(MEM_SIZE)
+	e.SetFS(fsys)
+	fd, err := e.files.Open("/data", O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.files.Read(fd, make([]uint8, 4)); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "snapshot")
+	if err := e.SaveSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	fsys, err = NewHostFS(moved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSnapshot(path, fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]uint8, 6)
+	if n, err := loaded.files.Read(fd, buf); err != nil || string(buf[:n]) != "efghij" {
+		t.Fatalf("read %q, %v from the loaded file", buf[:n], err)
+	}
+}
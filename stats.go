@@ -0,0 +1,179 @@
+// memory statistics - how much of its memory a program uses and how it
+// accesses it.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"os"
+	"strings"
+)
+
+// ACCESS_BUCKETS is the number of power of two buckets in the access size
+// histogram, the last bucket holds everything bigger.
+const ACCESS_BUCKETS = 8
+
+// MemStats are the counters kept by the Mmu while statistics are enabled
+type MemStats struct {
+	touched      []bool
+	bytesRead    uint64
+	bytesWritten uint64
+	sizes        [ACCESS_BUCKETS]uint64
+
+	// lowest address written above the allocations, the deepest the stack got
+	stackLow VirtAddr
+
+	// highest the program break got
+	peakBrk VirtAddr
+}
+
+// EnableStats starts gathering memory statistics
+func (m *Mmu) EnableStats() {
+	m.stats = &MemStats{touched: make([]bool, len(m.pages)), stackLow: VirtAddr(m.size)}
+}
+
+// recordBrk notes the program break moving to `brk`
+func (s *MemStats) recordBrk(brk VirtAddr) {
+	if brk > s.peakBrk {
+		s.peakBrk = brk
+	}
+}
+
+// record an access of `size` bytes at `addr`, an empty access touches nothing
+func (s *MemStats) record(addr VirtAddr, size uint, write bool, curAlloc VirtAddr) {
+	if size == 0 {
+		return
+	}
+	if write {
+		s.bytesWritten += uint64(size)
+		if addr >= curAlloc && addr < s.stackLow {
+			s.stackLow = addr
+		}
+	} else {
+		s.bytesRead += uint64(size)
+	}
+
+	bucket := 0
+	if size > 1 {
+		bucket = bits.Len(size - 1)
+	}
+	if bucket >= ACCESS_BUCKETS {
+		bucket = ACCESS_BUCKETS - 1
+	}
+	s.sizes[bucket]++
+
+	for i := uint(addr) / PAGE_SIZE; i <= (uint(addr)+size-1)/PAGE_SIZE && i < uint(len(s.touched)); i++ {
+		s.touched[i] = true
+	}
+}
+
+// MemReport is the summary of a program's memory usage
+type MemReport struct {
+	MemSize         uint              `json:"mem_size"`
+	PageSize        uint              `json:"page_size"`
+	PagesTouched    uint              `json:"pages_touched"`
+	InitialBrk      uint64            `json:"initial_brk"`
+	PeakBrk         uint64            `json:"peak_brk"`
+	MmapRegions     []MemRegion       `json:"mmap_regions"`
+	StackSize       uint              `json:"stack_size"`
+	StackHighWater  uint              `json:"stack_high_water"`
+	BytesRead       uint64            `json:"bytes_read"`
+	BytesWritten    uint64            `json:"bytes_written"`
+	AccessSizeHisto map[string]uint64 `json:"access_sizes"`
+}
+
+// MemRegion is an address range given to the program
+type MemRegion struct {
+	Base uint64 `json:"base"`
+	Size uint   `json:"size"`
+}
+
+// MemReport summarises the memory statistics gathered since EnableStats
+func (e *Emulator) MemReport() MemReport {
+	s := e.stats
+	r := MemReport{
+		MemSize:         e.size,
+		PageSize:        PAGE_SIZE,
+		InitialBrk:      uint64(e.initialBrk),
+		PeakBrk:         uint64(e.programBrk),
+		MmapRegions:     []MemRegion{},
+		StackSize:       STACK_SIZE,
+		AccessSizeHisto: make(map[string]uint64),
+	}
+	for _, a := range e.allocs {
+		if strings.HasPrefix(a.site, "mmap") {
+			r.MmapRegions = append(r.MmapRegions, MemRegion{uint64(a.base), a.size})
+		}
+	}
+	if s == nil {
+		return r
+	}
+
+	for _, t := range s.touched {
+		if t {
+			r.PagesTouched++
+		}
+	}
+	if s.peakBrk > e.programBrk {
+		r.PeakBrk = uint64(s.peakBrk)
+	}
+	if s.stackLow < e.Stack() {
+		r.StackHighWater = uint(e.Stack() - s.stackLow)
+	}
+	r.BytesRead = s.bytesRead
+	r.BytesWritten = s.bytesWritten
+	for i, n := range s.sizes {
+		label := fmt.Sprintf("<=%d", 1<<i)
+		if i == ACCESS_BUCKETS-1 {
+			label = fmt.Sprintf(">%d", 1<<(i-1))
+		}
+		r.AccessSizeHisto[label] = n
+	}
+	return r
+}
+
+func (r MemReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "MEMORY USAGE\n")
+	fmt.Fprintf(&b, "pages touched: %d of %d (%#x bytes each)\n",
+		r.PagesTouched, (r.MemSize+r.PageSize-1)/r.PageSize, r.PageSize)
+	fmt.Fprintf(&b, "brk: %#x -> peak %#x (%d bytes)\n",
+		r.InitialBrk, r.PeakBrk, r.PeakBrk-r.InitialBrk)
+	for _, m := range r.MmapRegions {
+		fmt.Fprintf(&b, "mmap: [%#x -> %#x]\n", m.Base, m.Base+uint64(m.Size))
+	}
+	var stackUse uint
+	if r.StackSize != 0 {
+		stackUse = r.StackHighWater * 100 / r.StackSize
+	}
+	fmt.Fprintf(&b, "stack high-water: %#x of %#x (%d%%)\n",
+		r.StackHighWater, r.StackSize, stackUse)
+	fmt.Fprintf(&b, "bytes read: %d, bytes written: %d\n", r.BytesRead, r.BytesWritten)
+	fmt.Fprintf(&b, "access sizes:")
+	for i := 0; i < ACCESS_BUCKETS; i++ {
+		label := fmt.Sprintf("<=%d", 1<<i)
+		if i == ACCESS_BUCKETS-1 {
+			label = fmt.Sprintf(">%d", 1<<(i-1))
+		}
+		fmt.Fprintf(&b, " %s: %d", label, r.AccessSizeHisto[label])
+	}
+	return b.String()
+}
+
+// WriteJSON writes the report to `path` as JSON
+func (r MemReport) WriteJSON(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(file)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMemStatsRecord(t *testing.T) {
+	m := NewMmu(4 * PAGE_SIZE)
+	m.EnableStats()
+
+	// an empty access at the end of memory touches nothing
+	m.stats.record(VirtAddr(m.size), 0, true, m.curAlloc)
+	m.stats.record(0, 0, false, m.curAlloc)
+	for i, touched := range m.stats.touched {
+		if touched {
+			t.Fatalf("page %d touched by an empty access", i)
+		}
+	}
+
+	m.stats.record(PAGE_SIZE-1, 2, true, m.curAlloc)
+	want := []bool{true, true, false, false}
+	for i, touched := range m.stats.touched {
+		if touched != want[i] {
+			t.Errorf("page %d touched is %v, want %v", i, touched, want[i])
+		}
+	}
+	if m.stats.bytesWritten != 2 {
+		t.Errorf("%d bytes written, want 2", m.stats.bytesWritten)
+	}
+}
+
+func TestMemReportNoStack(t *testing.T) {
+	r := MemReport{PageSize: PAGE_SIZE, AccessSizeHisto: map[string]uint64{}}
+	if !strings.Contains(r.String(), "stack high-water: 0x0 of 0x0 (0%)") {
+		t.Fatalf("report without a stack:\n%s", r)
+	}
+}
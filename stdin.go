@@ -0,0 +1,58 @@
+// standard input - what the program reads from fd 0, the host's terminal, a
+// file or input handed to the emulator by a fuzzer.
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// bytesFile is a read only file with fixed contents
+type bytesFile struct {
+	name string
+	data []uint8
+}
+
+func (b *bytesFile) ReadAt(buf []uint8, off int64) (int, error) {
+	if off >= int64(len(b.data)) {
+		return 0, io.EOF
+	}
+	return copy(buf, b.data[off:]), nil
+}
+
+func (b *bytesFile) WriteAt(buf []uint8, off int64) (int, error) { return 0, EBADF }
+
+func (b *bytesFile) Stat() (fs.FileInfo, error) {
+	return memInfo{b.name, &memNode{data: b.data, mode: 0444, modTime: time.Unix(0, 0)}}, nil
+}
+
+func (b *bytesFile) Close() error { return nil }
+
+// hostFile is a file opened on the host by the emulator rather than through
+// the program's filesystem
+type hostFile struct{ *os.File }
+
+// StdinFrom makes the program read standard input from `r`, like a pipe
+func (e *Emulator) StdinFrom(r io.Reader) {
+	e.files.SetStream(0, r, nil)
+}
+
+// StdinBytes makes the program read `input` as standard input, like a file
+// redirected to it. Forks read it from the position the emulator is at and
+// start over from there when they are reset.
+func (e *Emulator) StdinBytes(input []uint8) {
+	e.files.setFile(0, &bytesFile{"stdin", input}, "/dev/stdin", O_RDONLY, false)
+}
+
+// StdinFile makes the program read standard input from the host file at
+// `path`, like a file redirected to it
+func (e *Emulator) StdinFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	e.files.setFile(0, &hostFile{file}, "/dev/stdin", O_RDONLY, false)
+	return nil
+}
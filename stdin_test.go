@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readStdin reads standard input `count` bytes at a time through the read
+// syscall until it returns nothing
+func readStdin(t *testing.T, e *Emulator, count uint64) string {
+	t.Helper()
+	addr := doSyscall(t, e, 222, 0, PAGE_SIZE, PROT_READ|PROT_WRITE, MAP_PRIVATE|MAP_ANONYMOUS, ^uint64(0), 0)
+	var got []uint8
+	for {
+		n := doSyscall(t, e, 63, 0, uint64(addr), count)
+		if n < 0 {
+			t.Fatalf("read returned %d", n)
+		}
+		if n == 0 {
+			return string(got)
+		}
+		buf := make([]uint8, n)
+		if err := e.ReadInto(VirtAddr(addr), buf); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, buf...)
+	}
+}
+
+func TestStdinBytes(t *testing.T) {
+	e := NewEmulator(1 << 20)
+	e.StdinBytes([]uint8("hello, world\n"))
+	if got := readStdin(t, e, 5); got != "hello, world\n" {
+		t.Fatalf("read %q", got)
+	}
+	if _, err := e.files.Write(0, []uint8("x")); err != EBADF {
+		t.Fatalf("write to stdin returned %v, want EBADF", err)
+	}
+}
+
+func TestStdinFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "input")
+	if err := os.WriteFile(path, []uint8("from a file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	e := NewEmulator(1 << 20)
+	if err := e.StdinFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := readStdin(t, e, 4); got != "from a file\n" {
+		t.Fatalf("read %q", got)
+	}
+}
+
+func TestStdinRedirected(t *testing.T) {
+	// a file handed over as the host's stdin is read only, unlike a terminal
+	f, err := os.Create(filepath.Join(t.TempDir(), "input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := NewFileTable(NewMemFS(), f, nil, nil)
+	if _, err := files.Write(0, []uint8("x")); err != EBADF {
+		t.Fatalf("write to stdin returned %v, want EBADF", err)
+	}
+	if info, _ := f.Stat(); info.Size() != 0 {
+		t.Fatal("write to stdin reached the file")
+	}
+}
+
+func TestReadIntoDevice(t *testing.T) {
+	// a read into device memory fails before anything is taken from the file
+	e := NewEmulator(1 << 20)
+	dev := e.Allocate(PAGE_SIZE)
+	if err := e.MapDevice(dev, UART_SIZE, NewUART(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	e.StdinBytes([]uint8("hello"))
+	if n := doSyscall(t, e, 63, 0, uint64(dev), 3); n != -int64(EFAULT) {
+		t.Fatalf("read into a device returned %d", n)
+	}
+	if got := readStdin(t, e, 5); got != "hello" {
+		t.Fatalf("read %q after the failed read", got)
+	}
+}
@@ -1,19 +1,40 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
-	"unsafe"
+	"math"
 )
 
 // syscalls is the syscall table, it maps the syscall number to the syscall
 // function.
 var syscalls = map[uint64]func(e *Emulator, s SysCall) error{
+	17:  sys_getcwd,
+	23:  sys_dup,
+	34:  sys_mkdirat,
+	35:  sys_unlinkat,
+	38:  sys_renameat,
+	49:  sys_chdir,
+	56:  sys_openat,
+	57:  sys_close,
+	61:  sys_getdents64,
+	62:  sys_lseek,
+	63:  sys_read,
 	64:  sys_write,
 	66:  sys_writev,
+	67:  sys_pread64,
+	68:  sys_pwrite64,
+	79:  sys_newfstatat,
+	80:  sys_fstat,
 	94:  sys_exit, // exit_group
 	93:  sys_exit,
+	96:  sys_set_tid_address,
 	214: sys_brk,
+	215: sys_munmap,
 	222: sys_mmap,
+	226: sys_mprotect,
+	276: sys_renameat2,
+	291: sys_statx,
 }
 
 // SysCall contains the syscall number and arguments. It also double as an
@@ -49,73 +70,134 @@ func (e *Emulator) TrapIntoSystem() error {
 	return syscall.execute(e)
 }
 
-// read len(buf) from virtual memory and write it to file descriptor
-func (e *Emulator) write(fd int, addr VirtAddr, count int) MemErrType {
-	buf := make([]byte, count)
-	if err := e.ReadInto(addr, buf); err != nil {
-		return err.(MMUError).typ
-	}
-	n, _ := fmt.Fprintf(e.files[fd], "%s", buf)
-	// TODO(@Joe-Degs): currently executing the program in testdata/newlibc/duplicate
-	// results in a write that returns one less than what is actually written.
-	// So we return a meme error to further investigate the possible cause of the
-	// problem.
-	return MemErrType(n)
+// write writes `count` bytes from memory at `addr` to `fd`. A short write
+// is retried until everything is written or the file fails, the bytes written
+// so far are returned along with the error. The descriptor is checked even
+// when there is nothing to write.
+func (e *Emulator) write(fd int, addr VirtAddr, count uint64) (int, error) {
+	if err := e.files.Writable(fd); err != nil {
+		return 0, err
+	}
+	buf, err := e.guestBuf(addr, count)
+	if err != nil {
+		return 0, err
+	}
+	if e.ReadInto(addr, buf) != nil {
+		return 0, EFAULT
+	}
+	n := 0
+	for n < len(buf) {
+		m, err := e.files.Write(fd, buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			break
+		}
+	}
+	return n, nil
 }
 
 func (e *Emulator) RetVal(ret uint64) { e.SetReg(A0, ret) }
 
-// mmap syscall number 222
-func sys_mmap(e *Emulator, s SysCall) error {
-	e.RetVal(uint64(e.Heap()))
-	return nil
-}
-
-// ssize_t write(int fd, const void *buf, size_t count)
-// TODO(@Joe-Degs): this function is returning one less
-// actual amount of bytes read from memory or it is actually
-// reading one less than.
+// ssize_t write(int fd, const void *buf, size_t count);
 func sys_write(e *Emulator, s SysCall) error {
-	n := e.write(int(s.a0), VirtAddr(s.a1), int(s.a2))
-	fmt.Printf("sys_write: %d, wrote: %d\n", s.num, n)
-	e.RetVal(uint64(n))
-	return s
+	n, err := e.write(int(int32(s.a0)), VirtAddr(s.a1), s.a2)
+	if n > 0 {
+		err = nil
+	}
+	e.retErrno(uint64(n), err)
+	return nil
 }
 
 // void _exit(int status);
+// the only thread exits, the address from set_tid_address is cleared like the
+// kernel does and a bad address is ignored like it is there
 func sys_exit(e *Emulator, s SysCall) error {
-	fmt.Printf("exiting with %d\n", s.a0)
+	if e.tidAddress != 0 {
+		_ = WriteFromVal(e.Mmu, e.tidAddress, uint32(0))
+	}
 	return Done{int(s.a0)}
 }
 
-// A C scather/gather vector type
-// the good thing is I think struct packing works the same way in C as in go
-// if that is not the case, then I'm fucked royally (i wouldn't know what to do)
+// IOV_MAX is the most iovecs a writev can be given
+const IOV_MAX = 1024
+
+// IOVEC_SIZE is the size of a struct iovec
+//
+//	iov_base uint64
+//	iov_len  uint64
+const IOVEC_SIZE = 16
+
+// iovec is a buffer of a scatter/gather vector
 type iovec struct {
 	base VirtAddr
-	vlen int
+	len  uint64
+}
+
+// iovecs decodes the `count` little-endian iovecs in memory at `addr`
+func (e *Emulator) iovecs(addr VirtAddr, count uint64) ([]iovec, error) {
+	if count > IOV_MAX {
+		return nil, EINVAL
+	}
+	buf := make([]uint8, count*IOVEC_SIZE)
+	if e.ReadInto(addr, buf) != nil {
+		return nil, EFAULT
+	}
+	iovs := make([]iovec, count)
+	var total uint64
+	for i := range iovs {
+		iovs[i].base = VirtAddr(binary.LittleEndian.Uint64(buf[i*IOVEC_SIZE:]))
+		iovs[i].len = binary.LittleEndian.Uint64(buf[i*IOVEC_SIZE+8:])
+
+		// the total has to fit in the ssize_t returned
+		if total += iovs[i].len; total < iovs[i].len || total > math.MaxInt64 {
+			return nil, EINVAL
+		}
+	}
+	return iovs, nil
 }
 
 // ssize_t writev(int fd, const struct iovec *iov, int iovcnt);
-// write from a scatter vector
+// write from a scatter vector, a failure after some of it is written returns
+// what was written
 func sys_writev(e *Emulator, s SysCall) error {
-	size := unsafe.Sizeof(iovec{})
-	buf := make([]byte, size)
-	addr := VirtAddr(s.a1)
-	var n int
-	for i := 0; i < int(s.a2); i++ {
-		if err := e.ReadIntoPerms(addr, buf, PERM_READ); err != nil {
-			return err
+	if err := e.files.Writable(int(int32(s.a0))); err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	iovs, err := e.iovecs(VirtAddr(s.a1), uint64(int64(int32(s.a2))))
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	var total int
+	for _, iov := range iovs {
+		n, err := e.write(int(int32(s.a0)), iov.base, iov.len)
+		total += n
+		if err != nil {
+			if total == 0 {
+				e.retErrno(0, err)
+				return nil
+			}
+			break
 		}
-		iov := (*iovec)(unsafe.Pointer(&buf[0]))
-		if a := e.write(int(s.a0), iov.base, iov.vlen); a < 0 {
-			return MMUError{typ: a, addr: iov.base}
-		} else {
-			n += int(a)
+		if uint64(n) < iov.len {
+			break
 		}
-		addr += VirtAddr(size)
 	}
-	e.RetVal(uint64(n))
+	e.RetVal(uint64(total))
+	return nil
+}
+
+// TID is the thread id of the program's only thread
+const TID = 1
+
+// pid_t set_tid_address(int *tidptr);
+func sys_set_tid_address(e *Emulator, s SysCall) error {
+	e.tidAddress = VirtAddr(s.a0)
+	e.RetVal(TID)
 	return nil
 }
 
@@ -129,13 +211,20 @@ func sys_brk(e *Emulator, s SysCall) error {
 	}
 
 	if incr >= 0 {
-		base := e.Allocate(uint(incr))
-		// fmt.Printf("Incr: %#x, Base: %#x, Arg: %#x\n", incr, base, s.a0)
-		e.SetReg(A0, uint64(base+VirtAddr(incr)))
+		// the break stays where it is when memory runs out
+		base := e.AllocatePerms(uint(incr), allocPerm())
+		if base == 0 {
+			e.RetVal(uint64(e.programBrk))
+			return nil
+		}
+		e.TrackAllocation(base, uint(incr), fmt.Sprintf("brk at pc %#x", e.Reg(Pc)))
+		e.programBrk = base + VirtAddr(incr)
+		if e.stats != nil {
+			e.stats.recordBrk(e.programBrk)
+		}
+		e.SetReg(A0, uint64(e.programBrk))
 	} else {
 		e.SetReg(A0, ^uint64(0))
 	}
-
-	// e.SetReg(A0, 0)
 	return nil
 }
@@ -0,0 +1,212 @@
+// directory syscalls - list, create, remove and rename directory entries and
+// move around the filesystem.
+package main
+
+import (
+	"encoding/binary"
+	"io/fs"
+	"path"
+)
+
+// AT_REMOVEDIR makes unlinkat remove a directory
+const AT_REMOVEDIR = 0x200
+
+// d_type of a linux_dirent64
+const (
+	DT_UNKNOWN = 0
+	DT_FIFO    = 1
+	DT_CHR     = 2
+	DT_DIR     = 4
+	DT_BLK     = 6
+	DT_REG     = 8
+	DT_LNK     = 10
+	DT_SOCK    = 12
+)
+
+// DIRENT_HEADER is the size of a linux_dirent64 without its name
+//
+//	d_ino    uint64
+//	d_off    int64
+//	d_reclen uint16
+//	d_type   uint8
+//	d_name   [...]char
+const DIRENT_HEADER = 19
+
+// direntType is the d_type of a file of type `mode`
+func direntType(mode fs.FileMode) uint8 {
+	switch mode.Type() {
+	case 0:
+		return DT_REG
+	case fs.ModeDir:
+		return DT_DIR
+	case fs.ModeSymlink:
+		return DT_LNK
+	case fs.ModeNamedPipe:
+		return DT_FIFO
+	case fs.ModeSocket:
+		return DT_SOCK
+	case fs.ModeDevice | fs.ModeCharDevice:
+		return DT_CHR
+	case fs.ModeDevice:
+		return DT_BLK
+	}
+	return DT_UNKNOWN
+}
+
+// dirent is an entry of a directory listing
+type dirent struct {
+	name string
+	ino  uint64
+	typ  uint8
+}
+
+// listDir lists the entries of the directory `dir`, "." and ".." first
+func (e *Emulator) listDir(dir string) ([]dirent, error) {
+	entries, err := e.files.fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	all := []dirent{
+		{".", inode(dir), DT_DIR},
+		{"..", inode(path.Dir(dir)), DT_DIR},
+	}
+	for _, ent := range entries {
+		all = append(all, dirent{ent.Name(), inode(path.Join(dir, ent.Name())), direntType(ent.Type())})
+	}
+	return all, nil
+}
+
+// getdents lists the directory open as `fd` into `buf` as linux_dirent64
+// records. The file position counts the entries already listed. The directory
+// is listed once when reading from the start, files created or removed while
+// reading it don't move the entries not yet listed.
+func (e *Emulator) getdents(fd int, buf []uint8) (int, error) {
+	f, err := e.files.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if info, err := f.Stat(); err != nil {
+		return 0, err
+	} else if !info.IsDir() {
+		return 0, ENOTDIR
+	}
+	if f.off == 0 || f.dirents == nil {
+		if f.dirents, err = e.listDir(f.path); err != nil {
+			return 0, err
+		}
+	}
+
+	all, n := f.dirents, 0
+	for ; f.off < int64(len(all)); f.off++ {
+		ent := all[f.off]
+		reclen := (DIRENT_HEADER + len(ent.name) + 1 + 7) &^ 7
+		if n+reclen > len(buf) {
+			if n == 0 {
+				return 0, EINVAL
+			}
+			break
+		}
+		rec := buf[n : n+reclen]
+		binary.LittleEndian.PutUint64(rec[0:], ent.ino)
+		binary.LittleEndian.PutUint64(rec[8:], uint64(f.off+1))
+		binary.LittleEndian.PutUint16(rec[16:], uint16(reclen))
+		rec[18] = ent.typ
+		copy(rec[DIRENT_HEADER:], ent.name)
+		n += reclen
+	}
+	return n, nil
+}
+
+// ssize_t getdents64(int fd, void *dirp, size_t count);
+func sys_getdents64(e *Emulator, s SysCall) error {
+	buf, err := e.readBuf(VirtAddr(s.a1), s.a2)
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	n, err := e.getdents(int(int32(s.a0)), buf)
+	e.retErrno(uint64(n), e.copyOut(VirtAddr(s.a1), buf[:n], err))
+	return nil
+}
+
+// long getcwd(char *buf, unsigned long size);
+// the kernel returns the length of the path including the nul byte
+func sys_getcwd(e *Emulator, s SysCall) error {
+	cwd := append([]uint8(e.files.cwd), 0)
+	if uint64(len(cwd)) > s.a1 {
+		e.retErrno(0, ERANGE)
+		return nil
+	}
+	if e.WriteFrom(VirtAddr(s.a0), cwd) != nil {
+		e.retErrno(0, EFAULT)
+		return nil
+	}
+	e.RetVal(uint64(len(cwd)))
+	return nil
+}
+
+// int chdir(const char *path);
+func sys_chdir(e *Emulator, s SysCall) error {
+	name, err := e.resolve(AT_FDCWD, VirtAddr(s.a0))
+	if err == nil {
+		var info fs.FileInfo
+		if info, err = e.files.fs.Stat(name, true); err == nil && !info.IsDir() {
+			err = ENOTDIR
+		}
+	}
+	if err == nil {
+		e.files.cwd = name
+	}
+	e.retErrno(0, err)
+	return nil
+}
+
+// int mkdirat(int dirfd, const char *pathname, mode_t mode);
+func sys_mkdirat(e *Emulator, s SysCall) error {
+	name, err := e.resolve(int(int32(s.a0)), VirtAddr(s.a1))
+	if err == nil {
+		err = e.files.fs.Mkdir(name, fs.FileMode(s.a2&0o777))
+	}
+	e.retErrno(0, err)
+	return nil
+}
+
+// int unlinkat(int dirfd, const char *pathname, int flags);
+func sys_unlinkat(e *Emulator, s SysCall) error {
+	name, err := e.resolve(int(int32(s.a0)), VirtAddr(s.a1))
+	if err == nil {
+		if s.a2&^AT_REMOVEDIR != 0 {
+			err = EINVAL
+		} else {
+			err = e.files.fs.Remove(name, s.a2&AT_REMOVEDIR != 0)
+		}
+	}
+	e.retErrno(0, err)
+	return nil
+}
+
+// int renameat(int olddirfd, const char *oldpath, int newdirfd, const char *newpath);
+func sys_renameat(e *Emulator, s SysCall) error {
+	from, err := e.resolve(int(int32(s.a0)), VirtAddr(s.a1))
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	to, err := e.resolve(int(int32(s.a2)), VirtAddr(s.a3))
+	if err == nil {
+		err = e.files.fs.Rename(from, to)
+	}
+	e.retErrno(0, err)
+	return nil
+}
+
+// int renameat2(int olddirfd, const char *oldpath, int newdirfd,
+// const char *newpath, unsigned int flags);
+// none of the flags are supported
+func sys_renameat2(e *Emulator, s SysCall) error {
+	if s.a4 != 0 {
+		e.retErrno(0, EINVAL)
+		return nil
+	}
+	return sys_renameat(e, s)
+}
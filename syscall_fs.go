@@ -0,0 +1,163 @@
+// file syscalls - open, read and write files of the emulator's filesystem
+// through the file table.
+package main
+
+import (
+	"io/fs"
+	"path"
+)
+
+// PATH_MAX is the longest path a program can pass to a syscall
+const PATH_MAX = 4096
+
+// readString reads a nul terminated string of at most `max` bytes from memory
+func (e *Emulator) readString(addr VirtAddr, max int) (string, error) {
+	var (
+		str []uint8
+		b   [1]uint8
+	)
+	for len(str) < max {
+		if err := e.ReadInto(addr+VirtAddr(len(str)), b[:]); err != nil {
+			return "", EFAULT
+		}
+		if b[0] == 0 {
+			return string(str), nil
+		}
+		str = append(str, b[0])
+	}
+	return "", ENAMETOOLONG
+}
+
+// resolve reads the path at `addr` and makes it absolute, relative paths are
+// looked up from the directory open as `dirfd`, or the working directory for
+// AT_FDCWD
+func (e *Emulator) resolve(dirfd int, addr VirtAddr) (string, error) {
+	name, err := e.readString(addr, PATH_MAX)
+	if err != nil {
+		return "", err
+	}
+	if name == "" {
+		return "", ENOENT
+	}
+	if path.IsAbs(name) {
+		return path.Clean(name), nil
+	}
+	dir := e.files.cwd
+	if dirfd != AT_FDCWD {
+		f, err := e.files.get(dirfd)
+		if err != nil {
+			return "", err
+		}
+		dir = f.path
+	}
+	return path.Join(dir, name), nil
+}
+
+// guestBuf checks that `count` bytes at `addr` are in memory before a buffer
+// of that size is made for them
+func (e *Emulator) guestBuf(addr VirtAddr, count uint64) ([]uint8, error) {
+	if count > uint64(e.size) || !e.inBounds(addr, uint(count)) {
+		return nil, EFAULT
+	}
+	return make([]uint8, count), nil
+}
+
+// readBuf is a guestBuf for a syscall to read into. The memory has to be
+// writable before anything is read, a file position moved by a read into a
+// bad buffer would lose the data. Devices only take single loads and stores
+// so they are never read into.
+func (e *Emulator) readBuf(addr VirtAddr, count uint64) ([]uint8, error) {
+	buf, err := e.guestBuf(addr, count)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := e.device(addr, uint(count)); ok || !e.writable(addr, uint(count)) {
+		return nil, EFAULT
+	}
+	return buf, nil
+}
+
+// int openat(int dirfd, const char *pathname, int flags, mode_t mode);
+func sys_openat(e *Emulator, s SysCall) error {
+	name, err := e.resolve(int(int32(s.a0)), VirtAddr(s.a1))
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	fd, err := e.files.Open(name, int(s.a2), fs.FileMode(s.a3&0o7777))
+	e.retErrno(uint64(fd), err)
+	return nil
+}
+
+// int close(int fd);
+func sys_close(e *Emulator, s SysCall) error {
+	e.retErrno(0, e.files.Close(int(int32(s.a0))))
+	return nil
+}
+
+// int dup(int oldfd);
+func sys_dup(e *Emulator, s SysCall) error {
+	fd, err := e.files.Dup(int(int32(s.a0)))
+	e.retErrno(uint64(fd), err)
+	return nil
+}
+
+// off_t lseek(int fd, off_t offset, int whence);
+func sys_lseek(e *Emulator, s SysCall) error {
+	off, err := e.files.Seek(int(int32(s.a0)), int64(s.a1), int(s.a2))
+	e.retErrno(uint64(off), err)
+	return nil
+}
+
+// ssize_t read(int fd, void *buf, size_t count);
+func sys_read(e *Emulator, s SysCall) error {
+	buf, err := e.readBuf(VirtAddr(s.a1), s.a2)
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	n, err := e.files.Read(int(int32(s.a0)), buf)
+	e.retErrno(uint64(n), e.copyOut(VirtAddr(s.a1), buf[:n], err))
+	return nil
+}
+
+// ssize_t pread(int fd, void *buf, size_t count, off_t offset);
+func sys_pread64(e *Emulator, s SysCall) error {
+	buf, err := e.readBuf(VirtAddr(s.a1), s.a2)
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	n, err := e.files.Pread(int(int32(s.a0)), buf, int64(s.a3))
+	e.retErrno(uint64(n), e.copyOut(VirtAddr(s.a1), buf[:n], err))
+	return nil
+}
+
+// ssize_t pwrite(int fd, const void *buf, size_t count, off_t offset);
+func sys_pwrite64(e *Emulator, s SysCall) error {
+	buf, err := e.guestBuf(VirtAddr(s.a1), s.a2)
+	if err == nil {
+		if e.ReadInto(VirtAddr(s.a1), buf) != nil {
+			err = EFAULT
+		}
+	}
+	if err != nil {
+		e.retErrno(0, err)
+		return nil
+	}
+	n, err := e.files.Pwrite(int(int32(s.a0)), buf, int64(s.a3))
+	e.retErrno(uint64(n), err)
+	return nil
+}
+
+// copyOut writes the bytes a read returned into memory, `err` is the error of
+// the read itself and only reported when nothing was read
+func (e *Emulator) copyOut(addr VirtAddr, buf []uint8, err error) error {
+	if len(buf) == 0 {
+		return err
+	}
+	if e.WriteFrom(addr, buf) != nil {
+		return EFAULT
+	}
+	return nil
+}
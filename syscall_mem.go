@@ -0,0 +1,193 @@
+// memory syscalls - map files and anonymous memory into the program and change
+// the protection of what is mapped. Mappings are never given back, unmapped
+// memory just becomes inaccessible.
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// mmap protection and flag bits
+const (
+	PROT_NONE  = 0x0
+	PROT_READ  = 0x1
+	PROT_WRITE = 0x2
+	PROT_EXEC  = 0x4
+
+	MAP_SHARED    = 0x1
+	MAP_PRIVATE   = 0x2
+	MAP_TYPE      = 0xf
+	MAP_FIXED     = 0x10
+	MAP_ANONYMOUS = 0x20
+)
+
+// protPerm is the permission of memory mapped with `prot`
+func protPerm(prot uint64) Perm {
+	var perm Perm
+	if prot&PROT_READ != 0 {
+		perm |= PERM_READ
+	}
+	if prot&PROT_WRITE != 0 {
+		perm |= PERM_WRITE
+	}
+	if prot&PROT_EXEC != 0 {
+		perm |= PERM_EXEC
+	}
+	return perm
+}
+
+// anonPerm is the permission of anonymous memory mapped with `prot`. Like the
+// heap, memory the program can write has to be written before it is read
+// unless uninitialized reads are allowed.
+func anonPerm(prot uint64) Perm {
+	perm := protPerm(prot)
+	if perm&PERM_WRITE != 0 && !ALLOW_UNINIT_READ {
+		perm = perm&^PERM_READ | PERM_RAW
+	}
+	return perm
+}
+
+// pageRound rounds `size` up to a whole number of pages, false when that
+// doesn't fit in memory of `limit` bytes
+func pageRound(size uint, limit uint) (uint, bool) {
+	if size > limit {
+		return 0, false
+	}
+	size = (size + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	return size, size <= limit
+}
+
+// mapRegion finds room for `size` bytes at `addr`, or anywhere without
+// `fixed`. The region is page aligned and fully inside memory, below the
+// guard of the stack.
+func (e *Emulator) mapRegion(addr VirtAddr, size uint, fixed bool) (VirtAddr, error) {
+	size, ok := pageRound(size, uint(e.allocLimit))
+	if !ok {
+		return 0, ENOMEM
+	}
+	if fixed {
+		if addr&(PAGE_SIZE-1) != 0 {
+			return 0, EINVAL
+		}
+		if uint(addr) > uint(e.allocLimit)-size {
+			return 0, ENOMEM
+		}
+		// nothing is handed out over a fixed mapping later
+		if end := addr + VirtAddr(size); end > e.curAlloc {
+			e.curAlloc = end
+		}
+		return addr, nil
+	}
+
+	prev := e.curAlloc
+	e.curAlloc = (e.curAlloc + PAGE_SIZE - 1) &^ (PAGE_SIZE - 1)
+	base := e.AllocatePerms(size, 0)
+	if base == 0 {
+		e.curAlloc = prev
+		return 0, ENOMEM
+	}
+	return base, nil
+}
+
+// mmap maps `length` bytes of the file `fd` from `off`, or zeroes for an
+// anonymous mapping, and returns where they were mapped
+func (e *Emulator) mmap(s SysCall) (VirtAddr, error) {
+	addr, length, prot, flags, off := VirtAddr(s.a0), uint(s.a1), s.a2, s.a3, s.a5
+	switch {
+	case length == 0, off&(PAGE_SIZE-1) != 0:
+		return 0, EINVAL
+	case flags&MAP_TYPE != MAP_SHARED && flags&MAP_TYPE != MAP_PRIVATE:
+		return 0, EINVAL
+	}
+
+	// the contents are read before anything is mapped, a file that can't be
+	// read leaves memory alone
+	var data []uint8
+	perm := anonPerm(prot)
+	if flags&MAP_ANONYMOUS == 0 {
+		f, err := e.files.get(int(int32(s.a4)))
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case f.stream:
+			return 0, ENODEV
+		case f.flags&O_ACCMODE == O_WRONLY:
+			return 0, EACCES
+		case length > uint(e.allocLimit):
+			return 0, ENOMEM
+		}
+		data = make([]uint8, length)
+		n, err := f.ReadAt(data, int64(off))
+		if n == 0 && err != nil && err != io.EOF {
+			return 0, err
+		}
+		data = data[:n]
+		perm = protPerm(prot)
+	}
+
+	base, err := e.mapRegion(addr, length, flags&MAP_FIXED != 0)
+	if err != nil {
+		return 0, err
+	}
+	size, _ := pageRound(length, uint(e.allocLimit))
+
+	// whatever was mapped there before is replaced, the rest of the last page
+	// of a file mapping reads as zeroes
+	e.SetPermissions(base, size, PERM_WRITE)
+	if err := e.WriteFrom(base, append(data, make([]uint8, size-uint(len(data)))...)); err != nil {
+		return 0, err
+	}
+	e.SetPermissions(base, size, perm)
+	e.TrackAllocation(base, length, fmt.Sprintf("mmap at pc %#x", e.Reg(Pc)))
+	return base, nil
+}
+
+// void *mmap(void *addr, size_t length, int prot, int flags, int fd, off_t offset);
+// private and shared mappings are the same, writes to a mapped file are not
+// written back to it
+func sys_mmap(e *Emulator, s SysCall) error {
+	base, err := e.mmap(s)
+	e.retErrno(uint64(base), err)
+	return nil
+}
+
+// checkRange validates the page aligned range of `length` bytes at `addr`
+// given to munmap and mprotect
+func (e *Emulator) checkRange(addr VirtAddr, length uint) (uint, error) {
+	if addr&(PAGE_SIZE-1) != 0 {
+		return 0, EINVAL
+	}
+	size, ok := pageRound(length, e.size)
+	if !ok || uint(addr) > e.size-size {
+		return 0, ENOMEM
+	}
+	return size, nil
+}
+
+// int munmap(void *addr, size_t length);
+func sys_munmap(e *Emulator, s SysCall) error {
+	size, err := e.checkRange(VirtAddr(s.a0), uint(s.a1))
+	if err == nil && s.a1 == 0 {
+		err = EINVAL
+	}
+	if err == nil {
+		e.SetPermissions(VirtAddr(s.a0), size, 0)
+	}
+	e.retErrno(0, err)
+	return nil
+}
+
+// int mprotect(void *addr, size_t len, int prot);
+func sys_mprotect(e *Emulator, s SysCall) error {
+	size, err := e.checkRange(VirtAddr(s.a0), uint(s.a1))
+	if err == nil && s.a2&^(PROT_READ|PROT_WRITE|PROT_EXEC) != 0 {
+		err = EINVAL
+	}
+	if err == nil {
+		e.SetPermissions(VirtAddr(s.a0), size, protPerm(s.a2))
+	}
+	e.retErrno(0, err)
+	return nil
+}
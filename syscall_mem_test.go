@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// doSyscall runs syscall `num` with `args` and returns what it left in a0
+func doSyscall(t *testing.T, e *Emulator, num uint64, args ...uint64) int64 {
+	t.Helper()
+	regs := []Register{A0, A1, A2, A3, A4, A5}
+	for i, arg := range args {
+		e.SetReg(regs[i], arg)
+	}
+	e.SetReg(A7, num)
+	if err := e.TrapIntoSystem(); err != nil {
+		t.Fatalf("syscall %d: %v", num, err)
+	}
+	return int64(e.Reg(A0))
+}
+
+func TestMmapAnonymous(t *testing.T) {
+	e := NewEmulator(1 << 20)
+	addr := doSyscall(t, e, 222, 0, 0x1800, PROT_READ|PROT_WRITE, MAP_PRIVATE|MAP_ANONYMOUS, ^uint64(0), 0)
+	if addr <= 0 || addr&(PAGE_SIZE-1) != 0 {
+		t.Fatalf("mmap returned %#x", addr)
+	}
+
+	// like the heap, the mapping has to be written before it is read and the
+	// whole last page is mapped
+	buf := make([]uint8, 0x2000)
+	if err := e.ReadInto(VirtAddr(addr), buf); err == nil {
+		t.Fatal("read from an uninitialized mapping")
+	}
+	if err := e.WriteFrom(VirtAddr(addr), buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ReadInto(VirtAddr(addr), buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMmapAnonymousAllowUninit(t *testing.T) {
+	ALLOW_UNINIT_READ = true
+	defer func() { ALLOW_UNINIT_READ = false }()
+
+	e := NewEmulator(1 << 20)
+	addr := doSyscall(t, e, 222, 0, PAGE_SIZE, PROT_READ|PROT_WRITE, MAP_PRIVATE|MAP_ANONYMOUS, ^uint64(0), 0)
+	buf := make([]uint8, PAGE_SIZE)
+	if err := e.ReadInto(VirtAddr(addr), buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, make([]uint8, len(buf))) {
+		t.Fatal("anonymous mapping is not zeroed")
+	}
+}
+
+func TestMmapFile(t *testing.T) {
+	e := NewEmulator(1 << 20)
+	fsys := NewMemFS()
+	fsys.WriteFile("/lib/libc.so", []uint8("0123456789"), 0644)
+	e.SetFS(fsys)
+	fd, err := e.files.Open("/lib/libc.so", O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reserve room for the library like the dynamic linker does, then map
+	// the file over it
+	base := doSyscall(t, e, 222, 0, 2*PAGE_SIZE, PROT_NONE, MAP_PRIVATE|MAP_ANONYMOUS, ^uint64(0), 0)
+	if base <= 0 {
+		t.Fatalf("mmap returned %d", base)
+	}
+	addr := doSyscall(t, e, 222, uint64(base+PAGE_SIZE), 10, PROT_READ|PROT_EXEC, MAP_PRIVATE|MAP_FIXED, uint64(fd), 0)
+	if addr != base+PAGE_SIZE {
+		t.Fatalf("fixed mapping at %#x, want %#x", addr, base+PAGE_SIZE)
+	}
+	buf := make([]uint8, 12)
+	if err := e.ReadIntoPerms(VirtAddr(addr), buf, PERM_READ|PERM_EXEC); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "0123456789\x00\x00" {
+		t.Fatalf("mapped %q", buf)
+	}
+	if err := e.WriteFrom(VirtAddr(addr), []uint8{1}); err == nil {
+		t.Fatal("wrote to a read only mapping")
+	}
+	if err := e.ReadInto(VirtAddr(base), buf); err == nil {
+		t.Fatal("read from a PROT_NONE mapping")
+	}
+}
+
+func TestMmapErrors(t *testing.T) {
+	e := NewEmulator(1 << 20)
+	anon := uint64(MAP_PRIVATE | MAP_ANONYMOUS)
+	for _, tc := range []struct {
+		name string
+		args []uint64
+		want Errno
+	}{
+		{"zero length", []uint64{0, 0, PROT_READ, anon, ^uint64(0), 0}, EINVAL},
+		{"huge length", []uint64{0, ^uint64(0), PROT_READ, anon, ^uint64(0), 0}, ENOMEM},
+		{"no mapping type", []uint64{0, 0x10, PROT_READ, MAP_ANONYMOUS, ^uint64(0), 0}, EINVAL},
+		{"unaligned offset", []uint64{0, 0x10, PROT_READ, anon, ^uint64(0), 1}, EINVAL},
+		{"unaligned fixed", []uint64{0x1001, 0x10, PROT_READ, anon | MAP_FIXED, ^uint64(0), 0}, EINVAL},
+		{"fixed past memory", []uint64{1 << 20, 0x10, PROT_READ, anon | MAP_FIXED, ^uint64(0), 0}, ENOMEM},
+		{"bad fd", []uint64{0, 0x10, PROT_READ, MAP_PRIVATE, 9, 0}, EBADF},
+		{"stream", []uint64{0, 0x10, PROT_READ, MAP_PRIVATE, 1, 0}, ENODEV},
+	} {
+		if got := doSyscall(t, e, 222, tc.args...); got != -int64(tc.want) {
+			t.Errorf("%s: mmap returned %d, want -%s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMprotectMunmap(t *testing.T) {
+	e := NewEmulator(1 << 20)
+	addr := doSyscall(t, e, 222, 0, PAGE_SIZE, PROT_READ, MAP_PRIVATE|MAP_ANONYMOUS, ^uint64(0), 0)
+	if err := e.WriteFrom(VirtAddr(addr), []uint8{1}); err == nil {
+		t.Fatal("wrote to a read only mapping")
+	}
+	if ret := doSyscall(t, e, 226, uint64(addr), PAGE_SIZE, PROT_READ|PROT_WRITE); ret != 0 {
+		t.Fatalf("mprotect returned %d", ret)
+	}
+	if err := e.WriteFrom(VirtAddr(addr), []uint8{1}); err != nil {
+		t.Fatal(err)
+	}
+	if ret := doSyscall(t, e, 226, uint64(addr+1), PAGE_SIZE, PROT_READ); ret != -int64(EINVAL) {
+		t.Fatalf("unaligned mprotect returned %d", ret)
+	}
+	if ret := doSyscall(t, e, 215, uint64(addr), PAGE_SIZE); ret != 0 {
+		t.Fatalf("munmap returned %d", ret)
+	}
+	if err := e.ReadInto(VirtAddr(addr), make([]uint8, 1)); err == nil {
+		t.Fatal("read from unmapped memory")
+	}
+}
@@ -0,0 +1,241 @@
+// stat syscalls - describe files to the program in the layout of the Linux
+// RISC-V struct stat and struct statx.
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"io/fs"
+	"time"
+)
+
+// *at syscall flags
+const (
+	AT_SYMLINK_NOFOLLOW = 0x100
+	AT_EMPTY_PATH       = 0x1000
+)
+
+// file type and mode bits of st_mode
+const (
+	S_IFMT   = 0o170000
+	S_IFSOCK = 0o140000
+	S_IFLNK  = 0o120000
+	S_IFREG  = 0o100000
+	S_IFBLK  = 0o060000
+	S_IFDIR  = 0o040000
+	S_IFCHR  = 0o020000
+	S_IFIFO  = 0o010000
+	S_ISUID  = 0o4000
+	S_ISGID  = 0o2000
+	S_ISVTX  = 0o1000
+)
+
+// sizes of struct stat and struct statx
+const (
+	STAT_SIZE  = 128
+	STATX_SIZE = 256
+)
+
+// STATX_BASIC_STATS is the statx mask of the fields filled in
+const STATX_BASIC_STATS = 0x7ff
+
+// devices the program's files are on, the standard streams are terminals
+var (
+	FILES_DEV = makedev(0, 0x20)
+	TTY_RDEV  = makedev(136, 0)
+)
+
+// makedev encodes a device number the way Linux does
+func makedev(major, minor uint64) uint64 {
+	return minor&0xff | (major&0xfff)<<8 | (minor&^0xff)<<12 | (major&^0xfff)<<32
+}
+
+// linuxStat is what a program gets to know about a file
+type linuxStat struct {
+	dev, ino, rdev   uint64
+	mode, nlink      uint32
+	uid, gid         uint32
+	size, blocks     int64
+	blksize          int32
+	atim, mtim, ctim time.Time
+}
+
+// inode is the inode number of the file at `path`, derived from the path so
+// it is the same on every run
+func inode(path string) uint64 {
+	h := fnv.New64a()
+	h.Write([]uint8(path))
+	return h.Sum64()
+}
+
+// statOf describes the file at `path` from its `info`
+func statOf(path string, info fs.FileInfo) linuxStat {
+	mode := uint32(info.Mode().Perm())
+	m := info.Mode()
+	switch {
+	case m&fs.ModeDir != 0:
+		mode |= S_IFDIR
+	case m&fs.ModeSymlink != 0:
+		mode |= S_IFLNK
+	case m&fs.ModeCharDevice != 0:
+		mode |= S_IFCHR
+	case m&fs.ModeDevice != 0:
+		mode |= S_IFBLK
+	case m&fs.ModeNamedPipe != 0:
+		mode |= S_IFIFO
+	case m&fs.ModeSocket != 0:
+		mode |= S_IFSOCK
+	default:
+		mode |= S_IFREG
+	}
+	if m&fs.ModeSetuid != 0 {
+		mode |= S_ISUID
+	}
+	if m&fs.ModeSetgid != 0 {
+		mode |= S_ISGID
+	}
+	if m&fs.ModeSticky != 0 {
+		mode |= S_ISVTX
+	}
+
+	st := linuxStat{
+		dev:     FILES_DEV,
+		ino:     inode(path),
+		mode:    mode,
+		nlink:   1,
+		size:    info.Size(),
+		blksize: PAGE_SIZE,
+		blocks:  (info.Size() + 511) / 512,
+		atim:    info.ModTime(),
+		mtim:    info.ModTime(),
+		ctim:    info.ModTime(),
+	}
+	if info.IsDir() {
+		st.nlink = 2
+	}
+	if mode&S_IFMT == S_IFCHR {
+		st.rdev = TTY_RDEV
+	}
+	return st
+}
+
+// stat encodes `st` as a struct stat
+func (st linuxStat) stat() []uint8 {
+	buf := make([]uint8, STAT_SIZE)
+	le := binary.LittleEndian
+	le.PutUint64(buf[0:], st.dev)
+	le.PutUint64(buf[8:], st.ino)
+	le.PutUint32(buf[16:], st.mode)
+	le.PutUint32(buf[20:], st.nlink)
+	le.PutUint32(buf[24:], st.uid)
+	le.PutUint32(buf[28:], st.gid)
+	le.PutUint64(buf[32:], st.rdev)
+	le.PutUint64(buf[48:], uint64(st.size))
+	le.PutUint32(buf[56:], uint32(st.blksize))
+	le.PutUint64(buf[64:], uint64(st.blocks))
+	for i, t := range []time.Time{st.atim, st.mtim, st.ctim} {
+		le.PutUint64(buf[72+16*i:], uint64(t.Unix()))
+		le.PutUint64(buf[80+16*i:], uint64(t.Nanosecond()))
+	}
+	return buf
+}
+
+// statx encodes `st` as a struct statx
+func (st linuxStat) statx() []uint8 {
+	buf := make([]uint8, STATX_SIZE)
+	le := binary.LittleEndian
+	le.PutUint32(buf[0:], STATX_BASIC_STATS)
+	le.PutUint32(buf[4:], uint32(st.blksize))
+	le.PutUint32(buf[16:], st.nlink)
+	le.PutUint32(buf[20:], st.uid)
+	le.PutUint32(buf[24:], st.gid)
+	le.PutUint16(buf[28:], uint16(st.mode))
+	le.PutUint64(buf[32:], st.ino)
+	le.PutUint64(buf[40:], uint64(st.size))
+	le.PutUint64(buf[48:], uint64(st.blocks))
+
+	// atime, btime (not filled in), ctime and mtime
+	for _, ts := range []struct {
+		off int
+		t   time.Time
+	}{{64, st.atim}, {96, st.ctim}, {112, st.mtim}} {
+		le.PutUint64(buf[ts.off:], uint64(ts.t.Unix()))
+		le.PutUint32(buf[ts.off+8:], uint32(ts.t.Nanosecond()))
+	}
+
+	// major and minor numbers of rdev and dev
+	for i, dev := range []uint64{st.rdev, st.dev} {
+		le.PutUint32(buf[128+8*i:], uint32((dev>>8)&0xfff|(dev>>32)&^0xfff))
+		le.PutUint32(buf[132+8*i:], uint32(dev&0xff|(dev>>12)&^0xff))
+	}
+	return buf
+}
+
+// statFd describes the file open as `fd`
+func (e *Emulator) statFd(fd int) (linuxStat, error) {
+	f, err := e.files.get(fd)
+	if err != nil {
+		return linuxStat{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return linuxStat{}, err
+	}
+	return statOf(f.path, info), nil
+}
+
+// statAt describes the file at the path in memory at `addr`, the way the *at
+// stat syscalls do with `flags`
+func (e *Emulator) statAt(dirfd int, addr VirtAddr, flags int) (linuxStat, error) {
+	if flags&AT_EMPTY_PATH != 0 {
+		if name, err := e.readString(addr, PATH_MAX); err == nil && name == "" {
+			if dirfd == AT_FDCWD {
+				return e.statPath(e.files.cwd, true)
+			}
+			return e.statFd(dirfd)
+		}
+	}
+	name, err := e.resolve(dirfd, addr)
+	if err != nil {
+		return linuxStat{}, err
+	}
+	return e.statPath(name, flags&AT_SYMLINK_NOFOLLOW == 0)
+}
+
+func (e *Emulator) statPath(name string, follow bool) (linuxStat, error) {
+	info, err := e.files.fs.Stat(name, follow)
+	if err != nil {
+		return linuxStat{}, err
+	}
+	return statOf(name, info), nil
+}
+
+// putStat copies the encoded `buf` to memory at `addr` unless `err` is set
+func (e *Emulator) putStat(addr VirtAddr, buf []uint8, err error) {
+	if err == nil && e.WriteFrom(addr, buf) != nil {
+		err = EFAULT
+	}
+	e.retErrno(0, err)
+}
+
+// int fstat(int fd, struct stat *statbuf);
+func sys_fstat(e *Emulator, s SysCall) error {
+	st, err := e.statFd(int(int32(s.a0)))
+	e.putStat(VirtAddr(s.a1), st.stat(), err)
+	return nil
+}
+
+// int newfstatat(int dirfd, const char *pathname, struct stat *statbuf, int flags);
+func sys_newfstatat(e *Emulator, s SysCall) error {
+	st, err := e.statAt(int(int32(s.a0)), VirtAddr(s.a1), int(s.a3))
+	e.putStat(VirtAddr(s.a2), st.stat(), err)
+	return nil
+}
+
+// int statx(int dirfd, const char *pathname, int flags, unsigned int mask,
+// struct statx *statxbuf);
+func sys_statx(e *Emulator, s SysCall) error {
+	st, err := e.statAt(int(int32(s.a0)), VirtAddr(s.a1), int(s.a2))
+	e.putStat(VirtAddr(s.a4), st.statx(), err)
+	return nil
+}
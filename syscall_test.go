@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestExitClearsTidAddress(t *testing.T) {
+	e := NewEmulator(1 << 20)
+	addr := e.Allocate(8)
+	if err := WriteFromVal(e.Mmu, addr, ^uint64(0)); err != nil {
+		t.Fatal(err)
+	}
+	if tid := doSyscall(t, e, 96, uint64(addr)); tid != TID {
+		t.Fatalf("set_tid_address returned %d", tid)
+	}
+
+	e.SetReg(A0, 3)
+	e.SetReg(A7, 94)
+	if err := e.TrapIntoSystem(); err != (Done{3}) {
+		t.Fatalf("exit_group returned %v", err)
+	}
+	val, err := ReadIntoVal(e.Mmu, addr, uint64(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if val != 0xffffffff00000000 {
+		t.Fatalf("tid address holds %#x after exiting", val)
+	}
+}
+
+func TestEmptyWriteBadFd(t *testing.T) {
+	// nothing to write still fails on a descriptor that can't be written
+	e := NewEmulator(1 << 20)
+	e.StdinBytes([]uint8("input"))
+	addr := uint64(e.Allocate(16))
+	for _, tc := range []struct {
+		name string
+		num  uint64
+		args []uint64
+		want int64
+	}{
+		{"write bad fd", 64, []uint64{9, addr, 0}, -int64(EBADF)},
+		{"write stdin", 64, []uint64{0, addr, 0}, -int64(EBADF)},
+		{"write stdout", 64, []uint64{1, addr, 0}, 0},
+		{"writev bad fd", 66, []uint64{9, addr, 0}, -int64(EBADF)},
+		{"writev stdin", 66, []uint64{0, addr, 0}, -int64(EBADF)},
+		{"writev stdout", 66, []uint64{1, addr, 0}, 0},
+	} {
+		if got := doSyscall(t, e, tc.num, tc.args...); got != tc.want {
+			t.Errorf("%s: returned %d, want %d", tc.name, got, tc.want)
+		}
+	}
+}
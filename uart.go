@@ -0,0 +1,151 @@
+// 16550 UART - serial port used by bare-metal programs for console output,
+// laid out like the one on QEMU's virt machine.
+package main
+
+import (
+	"io"
+)
+
+const (
+	UART_BASE = 0x10000000 // where the UART sits on QEMU's virt machine
+	UART_SIZE = 0x100
+)
+
+// UART register offsets, RBR/THR and IER double as the divisor latch when
+// DLAB is set in LCR
+const (
+	UART_RBR = 0x0 // receive buffer (read)
+	UART_THR = 0x0 // transmit holding (write)
+	UART_IER = 0x1 // interrupt enable
+	UART_IIR = 0x2 // interrupt identification (read)
+	UART_FCR = 0x2 // fifo control (write)
+	UART_LCR = 0x3 // line control
+	UART_MCR = 0x4 // modem control
+	UART_LSR = 0x5 // line status
+	UART_MSR = 0x6 // modem status
+	UART_SCR = 0x7 // scratch
+
+	UART_LCR_DLAB = 0x80
+	UART_LSR_DR   = 0x01 // data ready
+	UART_LSR_THRE = 0x20 // transmit holding register empty
+	UART_LSR_TEMT = 0x40 // transmitter empty
+)
+
+// UART is a 16550 compatible serial port. Bytes the program transmits go to
+// `out` and bytes read from `in` are received by the program.
+type UART struct {
+	rx      chan uint8
+	pending *uint8
+	out     io.Writer
+
+	ier, fcr, lcr, mcr, scr, dll, dlm uint8
+}
+
+// NewUART creates a UART connected to `in` and `out`, `in` may be nil for a
+// port that never receives anything.
+func NewUART(in io.Reader, out io.Writer) *UART {
+	u := &UART{rx: make(chan uint8, 0x100), out: out}
+	if in != nil {
+		go u.receive(in)
+	}
+	return u
+}
+
+// receive feeds bytes from `in` to the UART until it runs dry
+func (u *UART) receive(in io.Reader) {
+	buf := make([]uint8, 0x100)
+	for {
+		n, err := in.Read(buf)
+		for _, b := range buf[:n] {
+			u.rx <- b
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ready reports whether a received byte is waiting to be read
+func (u *UART) ready() bool {
+	if u.pending == nil {
+		select {
+		case b := <-u.rx:
+			u.pending = &b
+		default:
+		}
+	}
+	return u.pending != nil
+}
+
+func (u *UART) Read(offset uint64, size uint) (uint64, error) {
+	dlab := u.lcr&UART_LCR_DLAB != 0
+	switch offset {
+	case UART_RBR:
+		if dlab {
+			return uint64(u.dll), nil
+		}
+		if !u.ready() {
+			return 0, nil
+		}
+		b := *u.pending
+		u.pending = nil
+		return uint64(b), nil
+	case UART_IER:
+		if dlab {
+			return uint64(u.dlm), nil
+		}
+		return uint64(u.ier), nil
+	case UART_IIR:
+		// no interrupt pending, fifo state mirrored from FCR
+		iir := uint64(0x01)
+		if u.fcr&0x01 != 0 {
+			iir |= 0xc0
+		}
+		return iir, nil
+	case UART_LCR:
+		return uint64(u.lcr), nil
+	case UART_MCR:
+		return uint64(u.mcr), nil
+	case UART_LSR:
+		// transmitting is instant so the transmitter is always empty
+		lsr := uint64(UART_LSR_THRE | UART_LSR_TEMT)
+		if u.ready() {
+			lsr |= UART_LSR_DR
+		}
+		return lsr, nil
+	case UART_MSR:
+		return 0xb0, nil // carrier detect, data set ready, clear to send
+	case UART_SCR:
+		return uint64(u.scr), nil
+	}
+	return 0, nil
+}
+
+func (u *UART) Write(offset uint64, size uint, val uint64) error {
+	b := uint8(val)
+	dlab := u.lcr&UART_LCR_DLAB != 0
+	switch offset {
+	case UART_THR:
+		if dlab {
+			u.dll = b
+			return nil
+		}
+		_, err := u.out.Write([]uint8{b})
+		return err
+	case UART_IER:
+		if dlab {
+			u.dlm = b
+			return nil
+		}
+		u.ier = b & 0x0f
+	case UART_FCR:
+		u.fcr = b
+	case UART_LCR:
+		u.lcr = b
+	case UART_MCR:
+		u.mcr = b & 0x1f
+	case UART_SCR:
+		u.scr = b
+	}
+	return nil
+}
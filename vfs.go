@@ -0,0 +1,431 @@
+// virtual filesystem - the files a program opens come from a pluggable
+// filesystem, the file table maps the program's file descriptors to them.
+package main
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// open flags as defined by Linux for RISC-V, filesystems are handed these
+// rather than the host's
+const (
+	O_RDONLY    = 0x0
+	O_WRONLY    = 0x1
+	O_RDWR      = 0x2
+	O_ACCMODE   = 0x3
+	O_CREAT     = 0x40
+	O_EXCL      = 0x80
+	O_NOCTTY    = 0x100
+	O_TRUNC     = 0x200
+	O_APPEND    = 0x400
+	O_NONBLOCK  = 0x800
+	O_DIRECTORY = 0x10000
+	O_NOFOLLOW  = 0x20000
+	O_CLOEXEC   = 0x80000
+)
+
+// lseek whence
+const (
+	SEEK_SET = 0
+	SEEK_CUR = 1
+	SEEK_END = 2
+)
+
+// AT_FDCWD makes the *at syscalls resolve relative paths from the current
+// working directory
+const AT_FDCWD = -100
+
+// MAX_FDS is the number of file descriptors a program can have open
+const MAX_FDS = 1024
+
+// File is an open file of a filesystem. Reads and writes are at explicit
+// offsets, the file position is kept by the file table.
+type File interface {
+	ReadAt(buf []uint8, off int64) (int, error)
+	WriteAt(buf []uint8, off int64) (int, error)
+	Stat() (fs.FileInfo, error)
+	Close() error
+}
+
+// FS is a filesystem the program opens files from. Names are absolute and
+// clean, flags and errors are the Linux ones.
+type FS interface {
+	OpenFile(name string, flags int, mode fs.FileMode) (File, error)
+
+	// Stat describes the file `name`, or the symbolic link itself when not
+	// following it
+	Stat(name string, follow bool) (fs.FileInfo, error)
+
+	// ReadDir lists the directory `name` sorted by file name
+	ReadDir(name string) ([]fs.DirEntry, error)
+
+	Mkdir(name string, mode fs.FileMode) error
+
+	// Remove removes the file, or with `dir` the empty directory, `name`
+	Remove(name string, dir bool) error
+
+	Rename(from, to string) error
+}
+
+// forkFS is a filesystem whose contents belong to one program, it is forked
+// with the file table. adopt moves a file open in the original filesystem to
+// the fork.
+type forkFS interface {
+	FS
+	Fork() (fork FS, adopt func(File) (File, bool))
+}
+
+// stream is a file without a position, like a terminal or a pipe. The offset
+// of reads and writes is ignored.
+type stream struct {
+	name string
+	r    io.Reader
+	w    io.Writer
+}
+
+func (s *stream) ReadAt(buf []uint8, off int64) (int, error) {
+	if s.r == nil {
+		return 0, EBADF
+	}
+	n, err := s.r.Read(buf)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (s *stream) WriteAt(buf []uint8, off int64) (int, error) {
+	if s.w == nil {
+		return 0, EBADF
+	}
+	return s.w.Write(buf)
+}
+
+func (s *stream) Stat() (fs.FileInfo, error) { return streamInfo{s.name}, nil }
+
+func (s *stream) Close() error { return nil }
+
+// streamInfo describes a stream as a character device
+type streamInfo struct{ name string }
+
+func (s streamInfo) Name() string       { return s.name }
+func (s streamInfo) Size() int64        { return 0 }
+func (s streamInfo) Mode() fs.FileMode  { return fs.ModeDevice | fs.ModeCharDevice | 0620 }
+func (s streamInfo) ModTime() time.Time { return time.Unix(0, 0) }
+func (s streamInfo) IsDir() bool        { return false }
+func (s streamInfo) Sys() any           { return nil }
+
+// handle is a File shared by the open files of forked file tables, it is
+// closed when the last of them lets go of it.
+type handle struct {
+	File
+	refs int32
+}
+
+func (h *handle) acquire() { atomic.AddInt32(&h.refs, 1) }
+
+func (h *handle) release() error {
+	if atomic.AddInt32(&h.refs, -1) == 0 {
+		return h.File.Close()
+	}
+	return nil
+}
+
+// openFile is an open file description, file descriptors duplicated with dup
+// share it and with it the file position.
+type openFile struct {
+	*handle
+	path   string
+	flags  int
+	off    int64
+	stream bool
+
+	// the entries of a directory as listed when reading it from the start,
+	// the file position indexes them
+	dirents []dirent
+
+	// file descriptors of the table referring to it
+	refs int
+}
+
+// FileTable holds the program's file descriptors, the filesystem files are
+// opened from and the working directory relative paths start from
+type FileTable struct {
+	fs  FS
+	fds map[int]*openFile
+	cwd string
+}
+
+// NewFileTable creates a file table for `fsys` with the standard streams
+// open. A nil stream is closed.
+func NewFileTable(fsys FS, stdin io.Reader, stdout, stderr io.Writer) *FileTable {
+	t := &FileTable{fs: fsys, fds: make(map[int]*openFile), cwd: "/"}
+	in := &stream{name: "stdin", r: stdin}
+	if tty, ok := stdin.(*os.File); ok {
+		// a terminal is open for reading and writing, a redirected file isn't
+		if info, err := tty.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			in.w = tty
+		}
+	}
+	t.install(0, in, stdin != nil)
+	t.install(1, &stream{name: "stdout", w: stdout}, stdout != nil)
+	t.install(2, &stream{name: "stderr", w: stderr}, stderr != nil)
+	return t
+}
+
+// install opens the stream `s` as `fd` when `ok`
+func (t *FileTable) install(fd int, s *stream, ok bool) {
+	if !ok {
+		return
+	}
+	flags := O_RDWR
+	if s.w == nil {
+		flags = O_RDONLY
+	} else if s.r == nil {
+		flags = O_WRONLY
+	}
+	t.setFile(fd, s, "/dev/"+s.name, flags, true)
+}
+
+// setFile opens `file` as `fd`, closing what was open as it
+func (t *FileTable) setFile(fd int, file File, path string, flags int, stream bool) {
+	_ = t.Close(fd)
+	t.fds[fd] = &openFile{
+		handle: &handle{File: file, refs: 1},
+		path:   path,
+		flags:  flags,
+		stream: stream,
+		refs:   1,
+	}
+}
+
+// SetStream replaces the standard stream `fd` with one reading from `r` and
+// writing to `w`, either may be nil
+func (t *FileTable) SetStream(fd int, r io.Reader, w io.Writer) {
+	names := [...]string{"stdin", "stdout", "stderr"}
+	t.install(fd, &stream{name: names[fd], r: r, w: w}, true)
+}
+
+// lowest unused file descriptor
+func (t *FileTable) free() (int, error) {
+	for fd := 0; fd < MAX_FDS; fd++ {
+		if _, ok := t.fds[fd]; !ok {
+			return fd, nil
+		}
+	}
+	return -1, EMFILE
+}
+
+func (t *FileTable) get(fd int) (*openFile, error) {
+	if f, ok := t.fds[fd]; ok {
+		return f, nil
+	}
+	return nil, EBADF
+}
+
+// Open opens the file at the absolute `path` and returns its descriptor
+func (t *FileTable) Open(path string, flags int, mode fs.FileMode) (int, error) {
+	fd, err := t.free()
+	if err != nil {
+		return -1, err
+	}
+	file, err := t.fs.OpenFile(path, flags, mode)
+	if err != nil {
+		return -1, err
+	}
+	t.fds[fd] = &openFile{
+		handle: &handle{File: file, refs: 1},
+		path:   path,
+		flags:  flags,
+		refs:   1,
+	}
+	return fd, nil
+}
+
+// Close closes `fd`, the file is closed with its last descriptor
+func (t *FileTable) Close(fd int) error {
+	f, err := t.get(fd)
+	if err != nil {
+		return err
+	}
+	delete(t.fds, fd)
+	if f.refs--; f.refs == 0 {
+		return f.release()
+	}
+	return nil
+}
+
+// Dup returns the lowest free descriptor referring to the same file as `fd`
+func (t *FileTable) Dup(fd int) (int, error) {
+	f, err := t.get(fd)
+	if err != nil {
+		return -1, err
+	}
+	dup, err := t.free()
+	if err != nil {
+		return -1, err
+	}
+	f.refs++
+	t.fds[dup] = f
+	return dup, nil
+}
+
+// Read reads from `fd` at its file position and advances it
+func (t *FileTable) Read(fd int, buf []uint8) (int, error) {
+	f, err := t.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	n, err := t.pread(f, buf, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// Pread reads from `fd` at `off` without moving the file position
+func (t *FileTable) Pread(fd int, buf []uint8, off int64) (int, error) {
+	f, err := t.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if f.stream {
+		return 0, ESPIPE
+	}
+	return t.pread(f, buf, off)
+}
+
+func (t *FileTable) pread(f *openFile, buf []uint8, off int64) (int, error) {
+	if f.flags&O_ACCMODE == O_WRONLY {
+		return 0, EBADF
+	}
+	if off < 0 {
+		return 0, EINVAL
+	}
+	n, err := f.ReadAt(buf, off)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Write writes to `fd` at its file position, or its end when opened for
+// appending, and advances it
+func (t *FileTable) Write(fd int, buf []uint8) (int, error) {
+	f, err := t.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if f.flags&O_APPEND != 0 && !f.stream {
+		info, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		f.off = info.Size()
+	}
+	n, err := t.pwrite(f, buf, f.off)
+	f.off += int64(n)
+	return n, err
+}
+
+// Pwrite writes to `fd` at `off` without moving the file position
+func (t *FileTable) Pwrite(fd int, buf []uint8, off int64) (int, error) {
+	f, err := t.get(fd)
+	if err != nil {
+		return 0, err
+	}
+	if f.stream {
+		return 0, ESPIPE
+	}
+	return t.pwrite(f, buf, off)
+}
+
+// Writable checks that `fd` is open for writing
+func (t *FileTable) Writable(fd int) error {
+	f, err := t.get(fd)
+	if err != nil {
+		return err
+	}
+	if f.flags&O_ACCMODE == O_RDONLY {
+		return EBADF
+	}
+	return nil
+}
+
+func (t *FileTable) pwrite(f *openFile, buf []uint8, off int64) (int, error) {
+	if f.flags&O_ACCMODE == O_RDONLY {
+		return 0, EBADF
+	}
+	if off < 0 {
+		return 0, EINVAL
+	}
+	return f.WriteAt(buf, off)
+}
+
+// Seek moves the file position of `fd`
+func (t *FileTable) Seek(fd int, off int64, whence int) (int64, error) {
+	f, err := t.get(fd)
+	if err != nil {
+		return -1, err
+	}
+	if f.stream {
+		return -1, ESPIPE
+	}
+	switch whence {
+	case SEEK_SET:
+	case SEEK_CUR:
+		off += f.off
+	case SEEK_END:
+		info, err := f.Stat()
+		if err != nil {
+			return -1, err
+		}
+		off += info.Size()
+	default:
+		return -1, EINVAL
+	}
+	if off < 0 {
+		return -1, EINVAL
+	}
+	f.off = off
+	return off, nil
+}
+
+// Fork copies the file table, the copy has its own file positions but shares
+// the open files until either side closes them. A filesystem private to the
+// program is forked too, with the files open in it.
+func (t *FileTable) Fork() *FileTable {
+	fork := &FileTable{fs: t.fs, fds: make(map[int]*openFile, len(t.fds)), cwd: t.cwd}
+	adopt := func(File) (File, bool) { return nil, false }
+	if f, ok := t.fs.(forkFS); ok {
+		fork.fs, adopt = f.Fork()
+	}
+
+	copies := make(map[*openFile]*openFile)
+	for fd, f := range t.fds {
+		c, ok := copies[f]
+		if !ok {
+			dup := *f
+			c = &dup
+			if file, ok := adopt(f.File); ok {
+				c.handle = &handle{File: file, refs: 1}
+			} else {
+				c.acquire()
+			}
+			copies[f] = c
+		}
+		fork.fds[fd] = c
+	}
+	return fork
+}
+
+// Reset makes the file table a copy of `parent`, closing files only it has
+// open and discarding changes made to a filesystem private to the program
+func (t *FileTable) Reset(parent *FileTable) {
+	for fd := range t.fds {
+		_ = t.Close(fd)
+	}
+	*t = *parent.Fork()
+}
@@ -0,0 +1,143 @@
+// memory watchpoints - stop execution when the program touches memory of
+// interest.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// WatchKind is the type of access a watchpoint fires on
+type WatchKind uint8
+
+const (
+	WATCH_READ   WatchKind = 0x1
+	WATCH_WRITE  WatchKind = 0x2
+	WATCH_ACCESS WatchKind = WATCH_READ | WATCH_WRITE
+)
+
+func (k WatchKind) String() string {
+	switch k {
+	case WATCH_READ:
+		return "r"
+	case WATCH_WRITE:
+		return "w"
+	case WATCH_ACCESS:
+		return "rw"
+	}
+	return fmt.Sprintf("WatchKind(%d)", uint8(k))
+}
+
+// Watchpoint watches `size` bytes from `addr` for accesses of kind `kind`
+type Watchpoint struct {
+	addr VirtAddr
+	size uint
+	kind WatchKind
+}
+
+// WatchpointHit is the reason execution stopped on a watchpoint. The access
+// that triggered it has completed.
+type WatchpointHit struct {
+	watch  Watchpoint
+	pc     uint64
+	access WatchKind
+	addr   VirtAddr
+	old    []uint8
+	new    []uint8
+}
+
+func (w WatchpointHit) Error() string {
+	return fmt.Sprintf(
+		"WatchpointHit{watch: %#x:%d:%s, pc: %#x, access: %s, addr: %#x, old: %#x, new: %#x}",
+		w.watch.addr, w.watch.size, w.watch.kind, w.pc, w.access, w.addr,
+		leValue(w.old), leValue(w.new),
+	)
+}
+
+// leValue interprets up to 8 bytes as a little-endian integer
+func leValue(buf []uint8) (val uint64) {
+	if len(buf) > 8 {
+		buf = buf[:8]
+	}
+	for i := len(buf) - 1; i >= 0; i-- {
+		val = val<<8 | uint64(buf[i])
+	}
+	return val
+}
+
+// Watch stops execution after any access of `kind` to `size` bytes at `addr`
+func (m *Mmu) Watch(addr VirtAddr, size uint, kind WatchKind) {
+	m.watchpoints = append(m.watchpoints, Watchpoint{addr, size, kind})
+}
+
+// Unwatch removes all watchpoints starting at `addr`
+func (m *Mmu) Unwatch(addr VirtAddr) {
+	kept := m.watchpoints[:0]
+	for _, w := range m.watchpoints {
+		if w.addr != addr {
+			kept = append(kept, w)
+		}
+	}
+	m.watchpoints = kept
+}
+
+// watched returns the first watchpoint of `kind` overlapping the access
+func (m *Mmu) watched(addr VirtAddr, size uint, kind WatchKind) (Watchpoint, bool) {
+	for _, w := range m.watchpoints {
+		if w.kind&kind != 0 && addr < w.addr+VirtAddr(w.size) && w.addr < addr+VirtAddr(size) {
+			return w, true
+		}
+	}
+	return Watchpoint{}, false
+}
+
+// TakeWatchpointHit returns and clears the watchpoint hit by the last access
+func (m *Mmu) TakeWatchpointHit() (WatchpointHit, bool) {
+	if m.hit == nil {
+		return WatchpointHit{}, false
+	}
+	hit := *m.hit
+	m.hit = nil
+	return hit, true
+}
+
+// watchFlags collects watchpoints given on the command line as
+// `addr:size:kind` where kind is one of r, w or rw.
+type watchFlags []Watchpoint
+
+func (w *watchFlags) String() string {
+	strs := make([]string, 0, len(*w))
+	for _, wp := range *w {
+		strs = append(strs, fmt.Sprintf("%#x:%d:%s", wp.addr, wp.size, wp.kind))
+	}
+	return strings.Join(strs, ",")
+}
+
+func (w *watchFlags) Set(val string) error {
+	parts := strings.Split(val, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("watchpoint %q is not of the form addr:size:kind", val)
+	}
+	addr, err := strconv.ParseUint(parts[0], 0, 64)
+	if err != nil {
+		return err
+	}
+	size, err := strconv.ParseUint(parts[1], 0, 64)
+	if err != nil {
+		return err
+	}
+	var kind WatchKind
+	switch parts[2] {
+	case "r":
+		kind = WATCH_READ
+	case "w":
+		kind = WATCH_WRITE
+	case "rw", "a":
+		kind = WATCH_ACCESS
+	default:
+		return fmt.Errorf("unknown watchpoint kind %q", parts[2])
+	}
+	*w = append(*w, Watchpoint{VirtAddr(addr), uint(size), kind})
+	return nil
+}